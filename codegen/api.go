@@ -3,7 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -12,6 +16,8 @@ import (
 type ApiError struct {
 	HTTPStatus int
 	Err        error
+	// Code - машиночитаемый код ошибки, попадает в problem+json
+	Code string
 }
 
 func (ae ApiError) Error() string {
@@ -26,9 +32,12 @@ const (
 	statusAdmin     = 20
 )
 
+// apigen:api {"rpc": "/user/rpc", "batch": "/user/batch", "versions": "/user/versions", "principal": "*User", "cors": {"origins": ["https://app.example.com"], "credentials": true, "maxAge": "10m"}}
 type MyApi struct {
 	statuses map[string]int
 	users    map[string]*User
+	tokens   map[string]string
+	avatars  map[string][]byte
 	nextID   uint64
 	mu       *sync.RWMutex
 }
@@ -48,8 +57,12 @@ func NewMyApi() *MyApi {
 				Status:   statusAdmin,
 			},
 		},
-		nextID: 43,
-		mu:     &sync.RWMutex{},
+		tokens: map[string]string{
+			"100500": "rvasily",
+		},
+		avatars: map[string][]byte{},
+		nextID:  43,
+		mu:      &sync.RWMutex{},
 	}
 }
 
@@ -58,24 +71,73 @@ type ProfileParams struct {
 }
 
 type CreateParams struct {
-	Login  string `apivalidator:"required, min = 10"`
+	Login  string `apivalidator:"required, min = 10" apimessages:"en.minlen=login must be at least {value} characters;ru.minlen=логин должен быть не короче {value} символов"`
 	Name   string `apivalidator:"paramname=full_name"`
 	Status string `apivalidator:"enum=user|moderator|admin,default=user"`
 	Age    int    `apivalidator:"min=0,max=128"`
 }
 
+type Pagination struct {
+	Limit int `apivalidator:"min=1,max=100,default=100"`
+}
+
+// LoginFilter приходит параметрами login.prefix и login.suffix
+type LoginFilter struct {
+	Prefix, Suffix string `apivalidator:"max=32"`
+}
+
+type ListParams struct {
+	Pagination
+	Status string `apivalidator:"enum=user|moderator|admin|all,default=all"`
+	Login  LoginFilter
+}
+
+type AvatarParams struct {
+	Login  string                `apivalidator:"required"`
+	Avatar *multipart.FileHeader `apivalidator:"required,maxsize=1MB,mime=image/png|image/jpeg"`
+}
+
 type User struct {
 	ID       uint64 `json:"id"`
 	Login    string `json:"login"`
 	FullName string `json:"full_name"`
 	Status   int    `json:"status"`
+
+	// кто создал пользователя, наружу не отдаём
+	createdBy uint64
+}
+
+type UserV2 struct {
+	ID       uint64 `json:"id"`
+	Login    string `json:"login"`
+	FullName string `json:"full_name"`
+	Status   string `json:"status"`
 }
 
 type NewUser struct {
 	ID uint64 `json:"id"`
 }
 
-// apigen:api {"url": "/user/profile", "auth": false}
+type Avatar struct {
+	Login string `json:"login"`
+	Size  int    `json:"size"`
+}
+
+// Authenticate вызывается сгенерированным кодом для методов с "auth": true,
+// найденный пользователь доступен в методе через UserFromContext
+func (srv *MyApi) Authenticate(ctx context.Context, token string) (*User, error) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	user, exist := srv.users[srv.tokens[token]]
+	if !exist {
+		return nil, fmt.Errorf("bad token")
+	}
+
+	return user, nil
+}
+
+// apigen:api {"url": "/user/profile", "auth": false, "cors": {"origins": ["*"], "maxAge": "1h"}, "deprecated": {"sunset": "2027-01-01"}, "cache": {"maxAge": "30s", "etag": true}}
 func (srv *MyApi) Profile(ctx context.Context, in ProfileParams) (*User, error) {
 
 	if in.Login == "bad_user" {
@@ -86,38 +148,130 @@ func (srv *MyApi) Profile(ctx context.Context, in ProfileParams) (*User, error)
 	user, exist := srv.users[in.Login]
 	srv.mu.RUnlock()
 	if !exist {
-		return nil, ApiError{http.StatusNotFound, fmt.Errorf("user not exist")}
+		return nil, ApiError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("user not exist"), Code: "user_not_exist"}
 	}
 
 	return user, nil
 }
 
+// apigen:api {"url": "/user/profile", "version": "v2", "auth": false, "cache": {"maxAge": "30s", "etag": true, "ttl": "1s"}}
+func (srv *MyApi) ProfileV2(ctx context.Context, in ProfileParams) (*UserV2, error) {
+	user, err := srv.Profile(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &UserV2{
+		ID:       user.ID,
+		Login:    user.Login,
+		FullName: user.FullName,
+	}
+	for name, status := range srv.statuses {
+		if status == user.Status {
+			profile.Status = name
+		}
+	}
+
+	return profile, nil
+}
+
 // apigen:api {"url": "/user/create", "auth": true, "method": "POST"}
 func (srv *MyApi) Create(ctx context.Context, in CreateParams) (*NewUser, error) {
 	if in.Login == "bad_username" {
 		return nil, fmt.Errorf("bad user")
 	}
 
+	creator, ok := UserFromContext(ctx)
+	if !ok {
+		return nil, ApiError{HTTPStatus: http.StatusForbidden, Err: fmt.Errorf("unauthorized")}
+	}
+	// нельзя создать пользователя со статусом выше своего
+	if srv.statuses[in.Status] > creator.Status {
+		return nil, ApiError{HTTPStatus: http.StatusForbidden, Err: fmt.Errorf("not enough rights"), Code: "not_enough_rights"}
+	}
+
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 
 	_, exist := srv.users[in.Login]
 	if exist {
-		return nil, ApiError{http.StatusConflict, fmt.Errorf("user %s exist", in.Login)}
+		return nil, ApiError{HTTPStatus: http.StatusConflict, Err: fmt.Errorf("user %s exist", in.Login), Code: "user_exist"}
 	}
 
 	id := srv.nextID
 	srv.nextID++
 	srv.users[in.Login] = &User{
-		ID:       id,
-		Login:    in.Login,
-		FullName: in.Name,
-		Status:   srv.statuses[in.Status],
+		ID:        id,
+		Login:     in.Login,
+		FullName:  in.Name,
+		Status:    srv.statuses[in.Status],
+		createdBy: creator.ID,
 	}
 
 	return &NewUser{id}, nil
 }
 
+// apigen:api {"url": "/user/list", "auth": false, "method": "GET"}
+func (srv *MyApi) List(ctx context.Context, in ListParams) (<-chan *User, error) {
+	srv.mu.RLock()
+	users := make([]*User, 0, len(srv.users))
+	for _, user := range srv.users {
+		if in.Status != "all" && user.Status != srv.statuses[in.Status] {
+			continue
+		}
+		if !strings.HasPrefix(user.Login, in.Login.Prefix) || !strings.HasSuffix(user.Login, in.Login.Suffix) {
+			continue
+		}
+		users = append(users, user)
+	}
+	srv.mu.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+	if len(users) > in.Limit {
+		users = users[:in.Limit]
+	}
+
+	out := make(chan *User)
+	go func() {
+		defer close(out)
+		for _, user := range users {
+			select {
+			case out <- user:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// apigen:api {"url": "/user/avatar", "auth": true, "method": "POST"}
+func (srv *MyApi) UploadAvatar(ctx context.Context, in AvatarParams) (*Avatar, error) {
+	file, err := in.Avatar.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if _, exist := srv.users[in.Login]; !exist {
+		return nil, ApiError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("user not exist"), Code: "user_not_exist"}
+	}
+	srv.avatars[in.Login] = data
+
+	return &Avatar{Login: in.Login, Size: len(data)}, nil
+}
+
 // 2-я часть
 // это похожая структура, с теми же методами, но у них другие параметры!
 // код, созданный вашим кодогенератором работает с конкретной струткурой, про другие ничего не знает
@@ -0,0 +1,75 @@
+package main
+import "context"
+import "errors"
+
+// MyApiServiceFake is a configurable MyApiService for handler tests
+type MyApiServiceFake struct {
+	AuthenticateFunc func(ctx context.Context, token string) (*User, error)
+	ProfileFunc func(ctx context.Context, in ProfileParams) (*User, error)
+	ProfileV2Func func(ctx context.Context, in ProfileParams) (*UserV2, error)
+	CreateFunc func(ctx context.Context, in CreateParams) (*NewUser, error)
+	ListFunc func(ctx context.Context, in ListParams) (<-chan *User, error)
+	UploadAvatarFunc func(ctx context.Context, in AvatarParams) (*Avatar, error)
+}
+
+func (fake *MyApiServiceFake) Authenticate(ctx context.Context, token string) (*User, error) {
+	if nil == fake.AuthenticateFunc {
+		var zero *User
+		return zero, errors.New("MyApiServiceFake.Authenticate is not configured")
+	}
+	return fake.AuthenticateFunc(ctx, token)
+}
+
+func (fake *MyApiServiceFake) Profile(ctx context.Context, in ProfileParams) (*User, error) {
+	if nil == fake.ProfileFunc {
+		var zero *User
+		return zero, errors.New("MyApiServiceFake.Profile is not configured")
+	}
+	return fake.ProfileFunc(ctx, in)
+}
+
+func (fake *MyApiServiceFake) ProfileV2(ctx context.Context, in ProfileParams) (*UserV2, error) {
+	if nil == fake.ProfileV2Func {
+		var zero *UserV2
+		return zero, errors.New("MyApiServiceFake.ProfileV2 is not configured")
+	}
+	return fake.ProfileV2Func(ctx, in)
+}
+
+func (fake *MyApiServiceFake) Create(ctx context.Context, in CreateParams) (*NewUser, error) {
+	if nil == fake.CreateFunc {
+		var zero *NewUser
+		return zero, errors.New("MyApiServiceFake.Create is not configured")
+	}
+	return fake.CreateFunc(ctx, in)
+}
+
+func (fake *MyApiServiceFake) List(ctx context.Context, in ListParams) (<-chan *User, error) {
+	if nil == fake.ListFunc {
+		var zero <-chan *User
+		return zero, errors.New("MyApiServiceFake.List is not configured")
+	}
+	return fake.ListFunc(ctx, in)
+}
+
+func (fake *MyApiServiceFake) UploadAvatar(ctx context.Context, in AvatarParams) (*Avatar, error) {
+	if nil == fake.UploadAvatarFunc {
+		var zero *Avatar
+		return zero, errors.New("MyApiServiceFake.UploadAvatar is not configured")
+	}
+	return fake.UploadAvatarFunc(ctx, in)
+}
+
+// OtherApiServiceFake is a configurable OtherApiService for handler tests
+type OtherApiServiceFake struct {
+	CreateFunc func(ctx context.Context, in OtherCreateParams) (*OtherUser, error)
+}
+
+func (fake *OtherApiServiceFake) Create(ctx context.Context, in OtherCreateParams) (*OtherUser, error) {
+	if nil == fake.CreateFunc {
+		var zero *OtherUser
+		return zero, errors.New("OtherApiServiceFake.Create is not configured")
+	}
+	return fake.CreateFunc(ctx, in)
+}
+
@@ -0,0 +1,187 @@
+package main
+import "context"
+import "encoding/json"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "testing"
+
+// fuzzMyApiService returns zero results, fuzz targets check
+// binding and validation, not the service
+type fuzzMyApiService struct{}
+
+func (fuzzMyApiService) Authenticate(ctx context.Context, token string) (*User, error) {
+	var result *User
+	return result, nil
+}
+
+func (fuzzMyApiService) Profile(ctx context.Context, in ProfileParams) (*User, error) {
+	var result *User
+	return result, nil
+}
+
+func (fuzzMyApiService) ProfileV2(ctx context.Context, in ProfileParams) (*UserV2, error) {
+	var result *UserV2
+	return result, nil
+}
+
+func (fuzzMyApiService) Create(ctx context.Context, in CreateParams) (*NewUser, error) {
+	var result *NewUser
+	return result, nil
+}
+
+func (fuzzMyApiService) List(ctx context.Context, in ListParams) (<-chan *User, error) {
+	result := make(chan *User)
+	close(result)
+	return result, nil
+}
+
+func (fuzzMyApiService) UploadAvatar(ctx context.Context, in AvatarParams) (*Avatar, error) {
+	var result *Avatar
+	return result, nil
+}
+
+func FuzzHandlerMyApiProfile(f *testing.F) {
+	f.Add("login=a", "{\"login\":\"a\"}")
+	f.Add("", "")
+	f.Fuzz(func(t *testing.T, form string, params string) {
+		handler := NewMyApiHandler(fuzzMyApiService{})
+		fuzzHandler(t, handler, envelopeLegacy, "GET", "/user/profile", form, false)
+		fuzzHandler(t, handler, envelopeLegacy, "POST", "/user/profile", form, false)
+		fuzzBinder(t, params, func(src paramSource) error {
+			_, err := bindProfileParams(src, "")
+			return err
+		})
+	})
+}
+
+func FuzzHandlerMyApiProfileV2(f *testing.F) {
+	f.Add("login=a", "{\"login\":\"a\"}")
+	f.Add("", "")
+	f.Fuzz(func(t *testing.T, form string, params string) {
+		handler := NewMyApiHandler(fuzzMyApiService{})
+		fuzzHandler(t, handler, envelopeLegacy, "GET", "/v2/user/profile", form, false)
+		fuzzHandler(t, handler, envelopeLegacy, "POST", "/v2/user/profile", form, false)
+		fuzzBinder(t, params, func(src paramSource) error {
+			_, err := bindProfileParams(src, "")
+			return err
+		})
+	})
+}
+
+func FuzzHandlerMyApiCreate(f *testing.F) {
+	f.Add("age=0&full_name=a&login=aaaaaaaaaa&status=user", "{\"age\":0,\"full_name\":\"a\",\"login\":\"aaaaaaaaaa\",\"status\":\"user\"}")
+	f.Add("", "")
+	f.Fuzz(func(t *testing.T, form string, params string) {
+		handler := NewMyApiHandler(fuzzMyApiService{})
+		fuzzHandler(t, handler, envelopeLegacy, "POST", "/user/create", form, false)
+		fuzzBinder(t, params, func(src paramSource) error {
+			_, err := bindCreateParams(src, "")
+			return err
+		})
+	})
+}
+
+func FuzzHandlerMyApiList(f *testing.F) {
+	f.Add("limit=1&login.prefix=a&login.suffix=a&status=user", "{\"limit\":1,\"login.prefix\":\"a\",\"login.suffix\":\"a\",\"status\":\"user\"}")
+	f.Add("", "")
+	f.Fuzz(func(t *testing.T, form string, params string) {
+		handler := NewMyApiHandler(fuzzMyApiService{})
+		fuzzHandler(t, handler, envelopeLegacy, "GET", "/user/list", form, true)
+		fuzzBinder(t, params, func(src paramSource) error {
+			_, err := bindListParams(src, "")
+			return err
+		})
+	})
+}
+
+func FuzzHandlerMyApiUploadAvatar(f *testing.F) {
+	f.Add("login=a", "{\"login\":\"a\"}")
+	f.Add("", "")
+	f.Fuzz(func(t *testing.T, form string, params string) {
+		handler := NewMyApiHandler(fuzzMyApiService{})
+		fuzzHandler(t, handler, envelopeLegacy, "POST", "/user/avatar", form, false)
+		fuzzBinder(t, params, func(src paramSource) error {
+			_, err := bindAvatarParams(src, "")
+			return err
+		})
+	})
+}
+
+// fuzzOtherApiService returns zero results, fuzz targets check
+// binding and validation, not the service
+type fuzzOtherApiService struct{}
+
+func (fuzzOtherApiService) Create(ctx context.Context, in OtherCreateParams) (*OtherUser, error) {
+	var result *OtherUser
+	return result, nil
+}
+
+func FuzzHandlerOtherApiCreate(f *testing.F) {
+	f.Add("account_name=a&class=warrior&level=1&username=aaa", "{\"account_name\":\"a\",\"class\":\"warrior\",\"level\":1,\"username\":\"aaa\"}")
+	f.Add("", "")
+	f.Fuzz(func(t *testing.T, form string, params string) {
+		handler := NewOtherApiHandler(fuzzOtherApiService{})
+		fuzzHandler(t, handler, envelopeLegacy, "POST", "/user/create", form, false)
+		fuzzBinder(t, params, func(src paramSource) error {
+			_, err := bindOtherCreateParams(src, "")
+			return err
+		})
+	})
+}
+
+// fuzzHandler fails the test unless the handler answers
+// with a success envelope or a 4xx ApiError
+func fuzzHandler(t *testing.T, handler http.Handler, env envelope, method string, target string, form string, stream bool) {
+	req := httptest.NewRequest(method, target, strings.NewReader(form))
+	if method == http.MethodGet {
+		req = httptest.NewRequest(method, target, nil)
+		req.URL.RawQuery = form
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Auth", "100500")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	body := rec.Body.Bytes()
+	switch {
+	case rec.Code == http.StatusOK && stream:
+	case rec.Code == http.StatusOK && env == envelopeLegacy:
+		response := make(map[string]interface{})
+		if err := json.Unmarshal(body, &response); nil != err || response["error"] != "" {
+			t.Errorf("%s %s?%s: bad success envelope %q", method, target, form, body)
+		}
+	case rec.Code == http.StatusOK:
+		if !json.Valid(body) {
+			t.Errorf("%s %s?%s: bad success envelope %q", method, target, form, body)
+		}
+	case rec.Code >= 400 && rec.Code < 500:
+		response := make(map[string]interface{})
+		key := "error"
+		if env == envelopeProblem {
+			key = "detail"
+		}
+		if err := json.Unmarshal(body, &response); nil != err || response[key] == "" || nil == response[key] {
+			t.Errorf("%s %s?%s: bad error envelope %q", method, target, form, body)
+		}
+	default:
+		t.Errorf("%s %s?%s: unexpected status %d: %q", method, target, form, rec.Code, body)
+	}
+}
+
+// fuzzBinder feeds JSON params to the binder the way JSON-RPC does,
+// the binder may only fail with a 4xx ApiError
+func fuzzBinder(t *testing.T, raw string, bind func(src paramSource) error) {
+	params, err := newRPCParams(json.RawMessage(raw))
+	if nil != err {
+		return
+	}
+	err = bind(params)
+	if nil == err {
+		return
+	}
+	apiError, ok := err.(ApiError)
+	if !ok || apiError.HTTPStatus < 400 || apiError.HTTPStatus >= 500 {
+		t.Errorf("params %s: binder failed with %#v", raw, err)
+	}
+}
\ No newline at end of file
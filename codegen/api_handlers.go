@@ -1,80 +1,447 @@
 package main
 import "net/http"
 import "strconv"
-import "context"
+import "strings"
 import "encoding/json"
 import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "bytes"
+import "mime/multipart"
+import "context"
+import "crypto/sha256"
+import "encoding/hex"
+import "net/url"
+import "sync"
+import "time"
+
+// UserFromContext returns the caller authenticated by the generated handler
+func UserFromContext(ctx context.Context) (*User, bool) {
+	principal, ok := principalFromContext(ctx).(*User)
+	return principal, ok
+}
+
+var corsMyApiProfile = &corsPolicy{
+	origins:     []string{"*"},
+	methods:     "GET, POST",
+	headers:     "Content-Type",
+	credentials: false,
+	maxAge:      3600,
+}
+
+var corsMyApiProfileV2 = &corsPolicy{
+	origins:     []string{"https://app.example.com"},
+	methods:     "GET, POST",
+	headers:     "Content-Type",
+	credentials: true,
+	maxAge:      600,
+}
+
+var corsMyApiCreate = &corsPolicy{
+	origins:     []string{"https://app.example.com"},
+	methods:     "POST",
+	headers:     "Content-Type, X-Auth",
+	credentials: true,
+	maxAge:      600,
+}
+
+var corsMyApiList = &corsPolicy{
+	origins:     []string{"https://app.example.com"},
+	methods:     "GET",
+	headers:     "Content-Type",
+	credentials: true,
+	maxAge:      600,
+}
+
+var corsMyApiUploadAvatar = &corsPolicy{
+	origins:     []string{"https://app.example.com"},
+	methods:     "POST",
+	headers:     "Content-Type, X-Auth",
+	credentials: true,
+	maxAge:      600,
+}
 
+var corsMyApiJSONRPC = &corsPolicy{
+	origins:     []string{"https://app.example.com"},
+	methods:     "POST",
+	headers:     "Content-Type, X-Auth",
+	credentials: true,
+	maxAge:      600,
+}
+
+var corsMyApiBatch = &corsPolicy{
+	origins:     []string{"https://app.example.com"},
+	methods:     "POST",
+	headers:     "Content-Type, X-Auth",
+	credentials: true,
+	maxAge:      600,
+}
+
+// MyApiService lists the annotated methods of MyApi
+type MyApiService interface {
+	Authenticate(ctx context.Context, token string) (*User, error)
+	Profile(ctx context.Context, in ProfileParams) (*User, error)
+	ProfileV2(ctx context.Context, in ProfileParams) (*UserV2, error)
+	Create(ctx context.Context, in CreateParams) (*NewUser, error)
+	List(ctx context.Context, in ListParams) (<-chan *User, error)
+	UploadAvatar(ctx context.Context, in AvatarParams) (*Avatar, error)
+}
+
+// MyApiHandler serves any implementation of MyApiService,
+// cached responses belong to the handler
+type MyApiHandler struct {
+	svc MyApiService
+	cacheMyApiProfile *responseCache
+	cacheMyApiProfileV2 *responseCache
+}
+
+func NewMyApiHandler(svc MyApiService) *MyApiHandler {
+	return &MyApiHandler{
+		svc: svc,
+		cacheMyApiProfile: &responseCache{
+			maxAge: 30,
+			etag:   true,
+		},
+		cacheMyApiProfileV2: &responseCache{
+			maxAge: 30,
+			etag:   true,
+			ttl:    1000000000, // 1s
+		},
+	}
+}
+
+// ServeHTTP makes a new handler for every request and never caches responses,
+// serve a handler of NewMyApiHandler to keep them between requests
 func (in *MyApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	NewMyApiHandler(in).ServeHTTP(w, r)
+}
+
+func (in *MyApi) ServeJSONRPC(w http.ResponseWriter, r *http.Request) {
+	NewMyApiHandler(in).ServeJSONRPC(w, r)
+}
+
+func (in *MyApiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if nil != r.Body {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodySize)
+	}
 	switch r.URL.Path {
 	case "/user/profile":
+		if !handleCORS(w, r, envelopeLegacy, corsMyApiProfile) {
+			return
+		}
+		if r.Method == "GET" {
+			in.handlerProfile(w, r)
+			return
+		}
+		if r.Method == "POST" {
+			in.handlerProfile(w, r)
+			return
+		}
+		apiError := ApiError{Err: errors.New("bad method"), HTTPStatus: http.StatusNotAcceptable}
+		envelopeLegacy.handleError(w, apiError)
+		return
+	case "/v2/user/profile":
+		if !handleCORS(w, r, envelopeLegacy, corsMyApiProfileV2) {
+			return
+		}
 		if r.Method == "GET" {
-			in.handlerProfile(w,r)
+			in.handlerProfileV2(w, r)
 			return
 		}
 		if r.Method == "POST" {
-			in.handlerProfile(w,r)
+			in.handlerProfileV2(w, r)
 			return
 		}
 		apiError := ApiError{Err: errors.New("bad method"), HTTPStatus: http.StatusNotAcceptable}
-		handleError(w, apiError)
+		envelopeLegacy.handleError(w, apiError)
 		return
 	case "/user/create":
+		if !handleCORS(w, r, envelopeLegacy, corsMyApiCreate) {
+			return
+		}
+		if r.Method == "POST" {
+			in.handlerCreate(w, r)
+			return
+		}
+		apiError := ApiError{Err: errors.New("bad method"), HTTPStatus: http.StatusNotAcceptable}
+		envelopeLegacy.handleError(w, apiError)
+		return
+	case "/user/list":
+		if !handleCORS(w, r, envelopeLegacy, corsMyApiList) {
+			return
+		}
+		if r.Method == "GET" {
+			in.handlerList(w, r)
+			return
+		}
+		apiError := ApiError{Err: errors.New("bad method"), HTTPStatus: http.StatusNotAcceptable}
+		envelopeLegacy.handleError(w, apiError)
+		return
+	case "/user/avatar":
+		if !handleCORS(w, r, envelopeLegacy, corsMyApiUploadAvatar) {
+			return
+		}
 		if r.Method == "POST" {
-			in.handlerCreate(w,r)
+			in.handlerUploadAvatar(w, r)
 			return
 		}
 		apiError := ApiError{Err: errors.New("bad method"), HTTPStatus: http.StatusNotAcceptable}
-		handleError(w, apiError)
+		envelopeLegacy.handleError(w, apiError)
+		return
+	case "/user/rpc":
+		if !handleCORS(w, r, envelopeLegacy, corsMyApiJSONRPC) {
+			return
+		}
+		in.ServeJSONRPC(w, r)
+		return
+	case "/user/batch":
+		if !handleCORS(w, r, envelopeLegacy, corsMyApiBatch) {
+			return
+		}
+		serveBatch(w, r, envelopeLegacy, in.ServeHTTP)
+		return
+	case "/user/versions":
+		envelopeLegacy.handleResult(w, versionsMyApi)
 		return
 	}
 	apiError := ApiError{Err: errors.New("unknown method"), HTTPStatus: http.StatusNotFound}
-	handleError(w, apiError)
+	envelopeLegacy.handleError(w, apiError)
 }
 
-func (in *MyApi) handlerProfile(w http.ResponseWriter, r *http.Request) {
-	params := ProfileParams{}
-	params.Login = r.FormValue("login")
-	if params.Login == "" {
-		apiError := ApiError{Err: errors.New("login must me not empty"), HTTPStatus: http.StatusBadRequest}
-		handleError(w, apiError)
+func (in *MyApiHandler) handlerProfile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Sunset", "Fri, 01 Jan 2027 00:00:00 GMT")
+	if err := parseForm(r); nil != err {
+		envelopeLegacy.handleError(w, err)
+		return
+	}
+	result, err := in.callProfile(r, r)
+	if nil != err {
+		envelopeLegacy.handleError(w, err)
 		return
 	}
-	result, err := in.Profile(context.Background(), params)
+	if r.Method != http.MethodGet {
+		envelopeLegacy.handleResult(w, result)
+		return
+	}
+	body, err := envelopeLegacy.encodeResult(result)
 	if nil != err {
-		handleError(w, err)
+		envelopeLegacy.handleError(w, err)
 		return
 	}
-	handleResult(w, result)
+	writeCached(w, r, body, in.cacheMyApiProfile)
 }
 
-func (in *MyApi) handlerCreate(w http.ResponseWriter, r *http.Request) {
-	token := r.Header.Get("X-Auth")
-	if token != "100500" {
-		apiError := ApiError{Err: errors.New("unauthorized"), HTTPStatus: http.StatusForbidden}
-		handleError(w, apiError)
+func (in *MyApiHandler) callProfile(r *http.Request, src paramSource) (*User, error) {
+	ctx := r.Context()
+	var zero *User
+	params, err := bindProfileParams(src, requestLocale(r))
+	if nil != err {
+		return zero, err
+	}
+	return in.svc.Profile(ctx, params)
+}
+
+func (in *MyApiHandler) handlerProfileV2(w http.ResponseWriter, r *http.Request) {
+	if err := parseForm(r); nil != err {
+		envelopeLegacy.handleError(w, err)
 		return
 	}
-	params := CreateParams{}
-	params.Login = r.FormValue("login")
-	params.Name = r.FormValue("full_name")
-	params.Status = r.FormValue("status")
-	Age, err := strconv.Atoi(r.FormValue("age"))
+	key := cacheKey(r, []string{"login"})
+	if body, ok := in.cacheMyApiProfileV2.get(key); ok && r.Method == http.MethodGet {
+		writeCached(w, r, body, in.cacheMyApiProfileV2)
+		return
+	}
+	result, err := in.callProfileV2(r, r)
+	if nil != err {
+		envelopeLegacy.handleError(w, err)
+		return
+	}
+	if r.Method != http.MethodGet {
+		envelopeLegacy.handleResult(w, result)
+		return
+	}
+	body, err := envelopeLegacy.encodeResult(result)
+	if nil != err {
+		envelopeLegacy.handleError(w, err)
+		return
+	}
+	in.cacheMyApiProfileV2.set(key, body)
+	writeCached(w, r, body, in.cacheMyApiProfileV2)
+}
+
+func (in *MyApiHandler) callProfileV2(r *http.Request, src paramSource) (*UserV2, error) {
+	ctx := r.Context()
+	var zero *UserV2
+	params, err := bindProfileParams(src, requestLocale(r))
+	if nil != err {
+		return zero, err
+	}
+	return in.svc.ProfileV2(ctx, params)
+}
+
+func (in *MyApiHandler) handlerCreate(w http.ResponseWriter, r *http.Request) {
+	if err := parseForm(r); nil != err {
+		envelopeLegacy.handleError(w, err)
+		return
+	}
+	result, err := in.callCreate(r, r)
+	if nil != err {
+		envelopeLegacy.handleError(w, err)
+		return
+	}
+	envelopeLegacy.handleResult(w, result)
+}
+
+func (in *MyApiHandler) callCreate(r *http.Request, src paramSource) (*NewUser, error) {
+	ctx := r.Context()
+	var zero *NewUser
+	principal, err := in.svc.Authenticate(ctx, r.Header.Get("X-Auth"))
+	if nil != err {
+		return zero, ApiError{Err: errors.New("unauthorized"), HTTPStatus: http.StatusForbidden}
+	}
+	ctx = context.WithValue(ctx, principalKey{}, principal)
+	params, err := bindCreateParams(src, requestLocale(r))
+	if nil != err {
+		return zero, err
+	}
+	return in.svc.Create(ctx, params)
+}
+
+func (in *MyApiHandler) handlerList(w http.ResponseWriter, r *http.Request) {
+	if err := parseForm(r); nil != err {
+		envelopeLegacy.handleError(w, err)
+		return
+	}
+	result, err := in.callList(r, r)
 	if nil != err {
-		apiError := ApiError{Err: errors.New("age must be int"), HTTPStatus: http.StatusBadRequest}
-		handleError(w, apiError)
+		envelopeLegacy.handleError(w, err)
 		return
 	}
+	stream := newStreamWriter(w, r)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case item, ok := <-result:
+			if !ok {
+				return
+			}
+			if err := stream.write(item); nil != err {
+				return
+			}
+		}
+	}
+}
+
+func (in *MyApiHandler) callList(r *http.Request, src paramSource) (<-chan *User, error) {
+	ctx := r.Context()
+	var zero <-chan *User
+	params, err := bindListParams(src, requestLocale(r))
+	if nil != err {
+		return zero, err
+	}
+	return in.svc.List(ctx, params)
+}
+
+func (in *MyApiHandler) handlerUploadAvatar(w http.ResponseWriter, r *http.Request) {
+	if err := parseForm(r); nil != err {
+		envelopeLegacy.handleError(w, err)
+		return
+	}
+	result, err := in.callUploadAvatar(r, r)
+	if nil != err {
+		envelopeLegacy.handleError(w, err)
+		return
+	}
+	envelopeLegacy.handleResult(w, result)
+}
+
+func (in *MyApiHandler) callUploadAvatar(r *http.Request, src paramSource) (*Avatar, error) {
+	ctx := r.Context()
+	var zero *Avatar
+	principal, err := in.svc.Authenticate(ctx, r.Header.Get("X-Auth"))
+	if nil != err {
+		return zero, ApiError{Err: errors.New("unauthorized"), HTTPStatus: http.StatusForbidden}
+	}
+	ctx = context.WithValue(ctx, principalKey{}, principal)
+	params, err := bindAvatarParams(src, requestLocale(r))
+	if nil != err {
+		return zero, err
+	}
+	return in.svc.UploadAvatar(ctx, params)
+}
+
+func (in *MyApiHandler) ServeJSONRPC(w http.ResponseWriter, r *http.Request) {
+	serveJSONRPC(w, r, envelopeLegacy, in.dispatchJSONRPC)
+}
+
+func (in *MyApiHandler) dispatchJSONRPC(r *http.Request, method string, params rpcParams) (interface{}, error) {
+	switch method {
+	case "MyApi.Profile":
+		result, err := in.callProfile(r, params)
+		if nil != err {
+			return nil, err
+		}
+		return result, nil
+	case "MyApi.ProfileV2":
+		result, err := in.callProfileV2(r, params)
+		if nil != err {
+			return nil, err
+		}
+		return result, nil
+	case "MyApi.Create":
+		result, err := in.callCreate(r, params)
+		if nil != err {
+			return nil, err
+		}
+		return result, nil
+	case "MyApi.UploadAvatar":
+		result, err := in.callUploadAvatar(r, params)
+		if nil != err {
+			return nil, err
+		}
+		return result, nil
+	}
+	return nil, errRPCMethodNotFound
+}
+
+var versionsMyApi = apiVersions{
+	Versions: []string{"v2"},
+	Endpoints: []apiEndpoint{
+		{URL: "/user/profile", Version: "", Method: "", Deprecated: true, Sunset: "2027-01-01"},
+		{URL: "/v2/user/profile", Version: "v2", Method: ""},
+		{URL: "/user/create", Version: "", Method: "POST"},
+		{URL: "/user/list", Version: "", Method: "GET"},
+		{URL: "/user/avatar", Version: "", Method: "POST"},
+	},
+}
+
+func bindProfileParams(src paramSource, locale string) (ProfileParams, error) {
+	params := ProfileParams{}
+	params.Login = src.FormValue("login")
+	if params.Login == "" {
+		return params, validationError(locale, "required", "login", "", nil)
+	}
+	return params, nil
+}
+
+func bindCreateParams(src paramSource, locale string) (CreateParams, error) {
+	params := CreateParams{}
+	params.Login = src.FormValue("login")
+	params.Name = src.FormValue("full_name")
+	params.Status = src.FormValue("status")
+	Age, err := strconv.Atoi(src.FormValue("age"))
+	if nil != err {
+		return params, validationError(locale, "type", "age", "int", nil)
+	}
 	params.Age = Age
 	if params.Login == "" {
-		apiError := ApiError{Err: errors.New("login must me not empty"), HTTPStatus: http.StatusBadRequest}
-		handleError(w, apiError)
-		return
+		return params, validationError(locale, "required", "login", "", map[string]string{"en.minlen":"login must be at least {value} characters", "ru.minlen":"логин должен быть не короче {value} символов"})
 	}
 	if len(params.Login) < 10 {
-		apiErr := ApiError{Err: errors.New("login len must be >= 10"), HTTPStatus: http.StatusBadRequest}
-		handleError(w, apiErr)
-		return
+		return params, validationError(locale, "minlen", "login", "10", map[string]string{"en.minlen":"login must be at least {value} characters", "ru.minlen":"логин должен быть не короче {value} символов"})
 	}
 	if params.Status == "" {
 		params.Status = "user"
@@ -82,70 +449,160 @@ func (in *MyApi) handlerCreate(w http.ResponseWriter, r *http.Request) {
 	if params.Status != "user" &&
 		params.Status != "moderator" &&
 		params.Status != "admin" {
-		apiErr := ApiError{Err: errors.New("status must be one of [user, moderator, admin]"), HTTPStatus: http.StatusBadRequest}
-		handleError(w, apiErr)
-		return
+		return params, validationError(locale, "enum", "status", "user, moderator, admin", nil)
 	}
 	if params.Age < 0 {
-		apiErr := ApiError{Err: errors.New("age must be >= 0"), HTTPStatus: http.StatusBadRequest}
-		handleError(w, apiErr)
-		return
+		return params, validationError(locale, "min", "age", "0", nil)
 	}
 	if params.Age > 128 {
-		apiErr := ApiError{Err: errors.New("age must be <= 128"), HTTPStatus: http.StatusBadRequest}
-		handleError(w, apiErr)
-		return
+		return params, validationError(locale, "max", "age", "128", nil)
+	}
+	return params, nil
+}
+
+func bindListParams(src paramSource, locale string) (ListParams, error) {
+	params := ListParams{}
+	if value := src.FormValue("limit"); value != "" {
+		PaginationLimit, err := strconv.Atoi(value)
+		if nil != err {
+			return params, validationError(locale, "type", "limit", "int", nil)
+		}
+		params.Pagination.Limit = PaginationLimit
+	}
+	params.Status = src.FormValue("status")
+	params.Login.Prefix = src.FormValue("login.prefix")
+	params.Login.Suffix = src.FormValue("login.suffix")
+	if params.Pagination.Limit == 0 {
+		params.Pagination.Limit = 100
+	}
+	if params.Pagination.Limit < 1 {
+		return params, validationError(locale, "min", "limit", "1", nil)
+	}
+	if params.Pagination.Limit > 100 {
+		return params, validationError(locale, "max", "limit", "100", nil)
+	}
+	if params.Status == "" {
+		params.Status = "all"
+	}
+	if params.Status != "user" &&
+		params.Status != "moderator" &&
+		params.Status != "admin" &&
+		params.Status != "all" {
+		return params, validationError(locale, "enum", "status", "user, moderator, admin, all", nil)
 	}
-	result, err := in.Create(context.Background(), params)
+	if len(params.Login.Prefix) > 32 {
+		return params, validationError(locale, "maxlen", "login.prefix", "32", nil)
+	}
+	if len(params.Login.Suffix) > 32 {
+		return params, validationError(locale, "maxlen", "login.suffix", "32", nil)
+	}
+	return params, nil
+}
+
+func bindAvatarParams(src paramSource, locale string) (AvatarParams, error) {
+	params := AvatarParams{}
+	params.Login = src.FormValue("login")
+	AvatarHeader, err := formFile(src, "avatar")
 	if nil != err {
-		handleError(w, err)
-		return
+		return params, validationError(locale, "type", "avatar", "file", nil)
+	}
+	params.Avatar = AvatarHeader
+	if params.Login == "" {
+		return params, validationError(locale, "required", "login", "", nil)
 	}
-	handleResult(w, result)
+	if nil == params.Avatar {
+		return params, validationError(locale, "required", "avatar", "", nil)
+	}
+	if nil != AvatarHeader && AvatarHeader.Size > 1048576 {
+		return params, validationError(locale, "maxsize", "avatar", "1MB", nil)
+	}
+	if nil != AvatarHeader && !checkFileType(AvatarHeader, []string{"image/png", "image/jpeg"}) {
+		return params, validationError(locale, "mime", "avatar", "image/png, image/jpeg", nil)
+	}
+	return params, nil
+}
+
+// OtherApiService lists the annotated methods of OtherApi
+type OtherApiService interface {
+	Create(ctx context.Context, in OtherCreateParams) (*OtherUser, error)
+}
+
+// OtherApiHandler serves any implementation of OtherApiService,
+// cached responses belong to the handler
+type OtherApiHandler struct {
+	svc OtherApiService
 }
 
+func NewOtherApiHandler(svc OtherApiService) *OtherApiHandler {
+	return &OtherApiHandler{svc: svc}
+}
+
+// ServeHTTP makes a new handler for every request and never caches responses,
+// serve a handler of NewOtherApiHandler to keep them between requests
 func (in *OtherApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	NewOtherApiHandler(in).ServeHTTP(w, r)
+}
+
+func (in *OtherApiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if nil != r.Body {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodySize)
+	}
 	switch r.URL.Path {
 	case "/user/create":
 		if r.Method == "POST" {
-			in.handlerCreate(w,r)
+			in.handlerCreate(w, r)
 			return
 		}
 		apiError := ApiError{Err: errors.New("bad method"), HTTPStatus: http.StatusNotAcceptable}
-		handleError(w, apiError)
+		envelopeLegacy.handleError(w, apiError)
 		return
 	}
 	apiError := ApiError{Err: errors.New("unknown method"), HTTPStatus: http.StatusNotFound}
-	handleError(w, apiError)
+	envelopeLegacy.handleError(w, apiError)
+}
+
+func (in *OtherApiHandler) handlerCreate(w http.ResponseWriter, r *http.Request) {
+	if err := parseForm(r); nil != err {
+		envelopeLegacy.handleError(w, err)
+		return
+	}
+	result, err := in.callCreate(r, r)
+	if nil != err {
+		envelopeLegacy.handleError(w, err)
+		return
+	}
+	envelopeLegacy.handleResult(w, result)
 }
 
-func (in *OtherApi) handlerCreate(w http.ResponseWriter, r *http.Request) {
+func (in *OtherApiHandler) callCreate(r *http.Request, src paramSource) (*OtherUser, error) {
+	ctx := r.Context()
+	var zero *OtherUser
 	token := r.Header.Get("X-Auth")
 	if token != "100500" {
-		apiError := ApiError{Err: errors.New("unauthorized"), HTTPStatus: http.StatusForbidden}
-		handleError(w, apiError)
-		return
+		return zero, ApiError{Err: errors.New("unauthorized"), HTTPStatus: http.StatusForbidden}
 	}
+	params, err := bindOtherCreateParams(src, requestLocale(r))
+	if nil != err {
+		return zero, err
+	}
+	return in.svc.Create(ctx, params)
+}
+
+func bindOtherCreateParams(src paramSource, locale string) (OtherCreateParams, error) {
 	params := OtherCreateParams{}
-	params.Username = r.FormValue("username")
-	params.Name = r.FormValue("account_name")
-	params.Class = r.FormValue("class")
-	Level, err := strconv.Atoi(r.FormValue("level"))
+	params.Username = src.FormValue("username")
+	params.Name = src.FormValue("account_name")
+	params.Class = src.FormValue("class")
+	Level, err := strconv.Atoi(src.FormValue("level"))
 	if nil != err {
-		apiError := ApiError{Err: errors.New("level must be int"), HTTPStatus: http.StatusBadRequest}
-		handleError(w, apiError)
-		return
+		return params, validationError(locale, "type", "level", "int", nil)
 	}
 	params.Level = Level
 	if params.Username == "" {
-		apiError := ApiError{Err: errors.New("username must me not empty"), HTTPStatus: http.StatusBadRequest}
-		handleError(w, apiError)
-		return
+		return params, validationError(locale, "required", "username", "", nil)
 	}
 	if len(params.Username) < 3 {
-		apiErr := ApiError{Err: errors.New("username len must be >= 3"), HTTPStatus: http.StatusBadRequest}
-		handleError(w, apiErr)
-		return
+		return params, validationError(locale, "minlen", "username", "3", nil)
 	}
 	if params.Class == "" {
 		params.Class = "warrior"
@@ -153,52 +610,759 @@ func (in *OtherApi) handlerCreate(w http.ResponseWriter, r *http.Request) {
 	if params.Class != "warrior" &&
 		params.Class != "sorcerer" &&
 		params.Class != "rouge" {
-		apiErr := ApiError{Err: errors.New("class must be one of [warrior, sorcerer, rouge]"), HTTPStatus: http.StatusBadRequest}
-		handleError(w, apiErr)
-		return
+		return params, validationError(locale, "enum", "class", "warrior, sorcerer, rouge", nil)
 	}
 	if params.Level < 1 {
-		apiErr := ApiError{Err: errors.New("level must be >= 1"), HTTPStatus: http.StatusBadRequest}
-		handleError(w, apiErr)
-		return
+		return params, validationError(locale, "min", "level", "1", nil)
 	}
 	if params.Level > 50 {
-		apiErr := ApiError{Err: errors.New("level must be <= 50"), HTTPStatus: http.StatusBadRequest}
-		handleError(w, apiErr)
-		return
+		return params, validationError(locale, "max", "level", "50", nil)
 	}
-	result, err := in.Create(context.Background(), params)
-	if nil != err {
-		handleError(w, err)
-		return
-	}
-	handleResult(w, result)
+	return params, nil
 }
 
-func handleError(w http.ResponseWriter, err error) {
+type envelope int
+
+const (
+	envelopeLegacy envelope = iota
+	envelopeBare
+	envelopeProblem
+)
+
+func (env envelope) handleError(w http.ResponseWriter, err error) {
 	apiError, ok := err.(ApiError)
 	if !ok {
 		apiError = ApiError{Err: err, HTTPStatus: http.StatusInternalServerError}
 	}
 	var response = make(map[string]interface{})
-	response["error"] = apiError.Err.Error()
+	contentType := "application/json"
+	switch env {
+	case envelopeLegacy:
+		response["error"] = apiError.Err.Error()
+	case envelopeBare:
+		response["error"] = apiError.Err.Error()
+		if apiError.Code != "" {
+			response["code"] = apiError.Code
+		}
+	case envelopeProblem:
+		contentType = "application/problem+json"
+		response["type"] = "about:blank"
+		if apiError.Code != "" {
+			response["type"] = "urn:apierror:" + apiError.Code
+			response["code"] = apiError.Code
+		}
+		response["title"] = http.StatusText(apiError.HTTPStatus)
+		response["status"] = apiError.HTTPStatus
+		response["detail"] = apiError.Err.Error()
+	}
 	body, err := json.Marshal(response)
 	if nil != err {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(apiError.HTTPStatus)
 	w.Write(body)
 }
 
-func handleResult(w http.ResponseWriter, result interface{}) {
-	var response = make(map[string]interface{})
-	response["response"] = result
-	response["error"] = ""
+func (env envelope) encodeResult(result interface{}) ([]byte, error) {
+	var response interface{} = result
+	if env == envelopeLegacy {
+		response = map[string]interface{}{
+			"response": result,
+			"error":    "",
+		}
+	}
+	return json.Marshal(response)
+}
+
+func (env envelope) handleResult(w http.ResponseWriter, result interface{}) {
+	body, err := env.encodeResult(result)
+	if nil != err {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+type streamWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	sse     bool
+}
+
+func newStreamWriter(w http.ResponseWriter, r *http.Request) *streamWriter {
+	stream := &streamWriter{w: w}
+	stream.flusher, _ = w.(http.Flusher)
+	stream.sse = strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if stream.sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+	stream.flush()
+	return stream
+}
+
+func (stream *streamWriter) write(item interface{}) error {
+	body, err := json.Marshal(item)
+	if nil != err {
+		return err
+	}
+	if stream.sse {
+		_, err = fmt.Fprintf(stream.w, "data: %s\n\n", body)
+	} else {
+		_, err = fmt.Fprintf(stream.w, "%s\n", body)
+	}
+	if nil != err {
+		return err
+	}
+	stream.flush()
+	return nil
+}
+
+func (stream *streamWriter) flush() {
+	if nil != stream.flusher {
+		stream.flusher.Flush()
+	}
+}
+
+// paramSource is where binders take raw values from,
+// *http.Request satisfies it
+type paramSource interface {
+	FormValue(key string) string
+	FormFile(key string) (multipart.File, *multipart.FileHeader, error)
+}
+
+// rpcParams are JSON-RPC named params flattened to strings
+type rpcParams map[string]string
+
+func (p rpcParams) FormValue(key string) string {
+	return p[key]
+}
+
+func (p rpcParams) FormFile(key string) (multipart.File, *multipart.FileHeader, error) {
+	return nil, nil, http.ErrMissingFile
+}
+
+func newRPCParams(raw json.RawMessage) (rpcParams, error) {
+	params := rpcParams{}
+	if len(raw) == 0 || string(raw) == "null" {
+		return params, nil
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(raw, &fields); nil != err {
+		return nil, err
+	}
+	for key, value := range fields {
+		params.add(key, value)
+	}
+	return params, nil
+}
+
+// add puts fields of nested objects under dotted keys, like address.city,
+// null is left out like a missing form value
+func (params rpcParams) add(key string, value json.RawMessage) {
+	if string(value) == "null" {
+		return
+	}
+	var str string
+	if err := json.Unmarshal(value, &str); nil == err {
+		params[key] = str
+		return
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(value, &fields); nil == err {
+		for field, fieldValue := range fields {
+			params.add(key+"."+field, fieldValue)
+		}
+		return
+	}
+	params[key] = string(value)
+}
+
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcServerError    = -32000
+)
+
+var errRPCMethodNotFound = errors.New("method not found")
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcDispatcher func(r *http.Request, method string, params rpcParams) (interface{}, error)
+
+func serveJSONRPC(w http.ResponseWriter, r *http.Request, env envelope, dispatch rpcDispatcher) {
+	if r.Method != http.MethodPost {
+		apiError := ApiError{Err: errors.New("bad method"), HTTPStatus: http.StatusNotAcceptable}
+		env.handleError(w, apiError)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if tooLarge(err) {
+		env.handleError(w, errTooLarge)
+		return
+	}
+	if nil != err {
+		writeRPC(w, rpcFailure(nil, rpcParseError, "parse error", nil))
+		return
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '[' {
+		response := handleRPC(r, body, dispatch)
+		if nil != response {
+			writeRPC(w, response)
+		}
+		return
+	}
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); nil != err {
+		writeRPC(w, rpcFailure(nil, rpcParseError, "parse error", nil))
+		return
+	}
+	if len(batch) == 0 {
+		writeRPC(w, rpcFailure(nil, rpcInvalidRequest, "invalid request", nil))
+		return
+	}
+	responses := make([]map[string]interface{}, 0, len(batch))
+	for _, raw := range batch {
+		if response := handleRPC(r, raw, dispatch); nil != response {
+			responses = append(responses, response)
+		}
+	}
+	if len(responses) != 0 {
+		writeRPC(w, responses)
+	}
+}
+
+// handleRPC returns nil for notifications, they get no response
+func handleRPC(r *http.Request, raw json.RawMessage, dispatch rpcDispatcher) map[string]interface{} {
+	req := rpcRequest{}
+	if err := json.Unmarshal(raw, &req); nil != err {
+		if _, ok := err.(*json.SyntaxError); ok {
+			return rpcFailure(nil, rpcParseError, "parse error", nil)
+		}
+		return rpcFailure(nil, rpcInvalidRequest, "invalid request", nil)
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return rpcFailure(req.ID, rpcInvalidRequest, "invalid request", nil)
+	}
+	params, err := newRPCParams(req.Params)
+	if nil != err {
+		if nil == req.ID {
+			return nil
+		}
+		return rpcFailure(req.ID, rpcInvalidParams, "params must be an object", nil)
+	}
+	result, err := dispatch(r, req.Method, params)
+	if nil == req.ID {
+		return nil
+	}
+	if nil != err {
+		return rpcErrorResponse(req.ID, err)
+	}
+	return map[string]interface{}{"jsonrpc": "2.0", "result": result, "id": req.ID}
+}
+
+func rpcErrorResponse(id json.RawMessage, err error) map[string]interface{} {
+	if err == errRPCMethodNotFound {
+		return rpcFailure(id, rpcMethodNotFound, err.Error(), nil)
+	}
+	apiError, ok := err.(ApiError)
+	if !ok {
+		return rpcFailure(id, rpcInternalError, err.Error(), nil)
+	}
+	code := rpcServerError
+	switch apiError.HTTPStatus {
+	case http.StatusBadRequest:
+		code = rpcInvalidParams
+	case http.StatusInternalServerError:
+		code = rpcInternalError
+	}
+	data := map[string]interface{}{"status": apiError.HTTPStatus}
+	return rpcFailure(id, code, apiError.Err.Error(), data)
+}
+
+func rpcFailure(id json.RawMessage, code int, message string, data interface{}) map[string]interface{} {
+	rpcError := map[string]interface{}{"code": code, "message": message}
+	if nil != data {
+		rpcError["data"] = data
+	}
+	if nil == id {
+		id = json.RawMessage("null")
+	}
+	return map[string]interface{}{"jsonrpc": "2.0", "error": rpcError, "id": id}
+}
+
+func writeRPC(w http.ResponseWriter, response interface{}) {
 	body, err := json.Marshal(response)
 	if nil != err {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	w.Write(body)
 }
+
+type corsPolicy struct {
+	origins     []string
+	methods     string
+	headers     string
+	credentials bool
+	maxAge      int
+}
+
+// handleCORS sets CORS headers and answers preflight requests,
+// false means the request is already answered
+func handleCORS(w http.ResponseWriter, r *http.Request, env envelope, policy *corsPolicy) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	w.Header().Add("Vary", "Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	allowed := policy.allowOrigin(origin)
+	if allowed == "" {
+		if preflight {
+			apiError := ApiError{Err: errors.New("origin not allowed"), HTTPStatus: http.StatusForbidden}
+			env.handleError(w, apiError)
+			return false
+		}
+		return true
+	}
+	w.Header().Set("Access-Control-Allow-Origin", allowed)
+	if policy.credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		return true
+	}
+	w.Header().Set("Access-Control-Allow-Methods", policy.methods)
+	if policy.headers != "" {
+		w.Header().Set("Access-Control-Allow-Headers", policy.headers)
+	}
+	if policy.maxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(policy.maxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return false
+}
+
+func (policy *corsPolicy) allowOrigin(origin string) string {
+	for _, allowed := range policy.origins {
+		if allowed == origin {
+			return origin
+		}
+		if allowed == "*" {
+			// a wildcard is not allowed together with credentials
+			if policy.credentials {
+				return origin
+			}
+			return "*"
+		}
+	}
+	return ""
+}
+
+// MaxBodySize limits request bodies of every generated handler
+var MaxBodySize int64 = 10 << 20
+
+var errTooLarge = ApiError{Err: errors.New("request body too large"), HTTPStatus: http.StatusRequestEntityTooLarge}
+
+func tooLarge(err error) bool {
+	var maxBytesError *http.MaxBytesError
+	return errors.As(err, &maxBytesError)
+}
+
+// parseForm parses the body up front, FormValue would swallow its errors
+func parseForm(r *http.Request) error {
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err = r.ParseMultipartForm(MaxBodySize)
+	} else {
+		err = r.ParseForm()
+	}
+	if nil == err {
+		return nil
+	}
+	if tooLarge(err) {
+		return errTooLarge
+	}
+	return ApiError{Err: err, HTTPStatus: http.StatusBadRequest}
+}
+
+// formFile returns nil header when the file was not sent
+func formFile(src paramSource, name string) (*multipart.FileHeader, error) {
+	file, header, err := src.FormFile(name)
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return nil, nil
+	}
+	if nil != err {
+		return nil, err
+	}
+	file.Close()
+	return header, nil
+}
+
+func readFile(header *multipart.FileHeader) ([]byte, error) {
+	if nil == header {
+		return nil, nil
+	}
+	file, err := header.Open()
+	if nil != err {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// checkFileType sniffs the content, the client supplied type is not trusted
+func checkFileType(header *multipart.FileHeader, allowed []string) bool {
+	file, err := header.Open()
+	if nil != err {
+		return false
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if nil != err && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false
+	}
+	fileType := http.DetectContentType(head[:n])
+	fileType = strings.TrimSpace(strings.Split(fileType, ";")[0])
+	for _, mimeType := range allowed {
+		if fileType == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+type apiVersions struct {
+	Versions  []string      `json:"versions"`
+	Endpoints []apiEndpoint `json:"endpoints"`
+}
+
+type apiEndpoint struct {
+	URL        string `json:"url"`
+	Version    string `json:"version,omitempty"`
+	Method     string `json:"method,omitempty"`
+	Deprecated bool   `json:"deprecated,omitempty"`
+	Sunset     string `json:"sunset,omitempty"`
+}
+
+type principalKey struct{}
+
+// principalFromContext is the untyped accessor behind the generated ones
+func principalFromContext(ctx context.Context) interface{} {
+	return ctx.Value(principalKey{})
+}
+
+const maxCacheEntries = 1024
+
+type cacheEntry struct {
+	body    []byte
+	expires time.Time
+}
+
+// responseCache holds the Cache-Control and ETag settings of an endpoint,
+// with ttl set it also keeps encoded responses in memory
+type responseCache struct {
+	maxAge  int
+	etag    bool
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func (cache *responseCache) get(key string) ([]byte, bool) {
+	if cache.ttl == 0 {
+		return nil, false
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(cache.entries, key)
+		return nil, false
+	}
+	return entry.body, true
+}
+
+func (cache *responseCache) set(key string, body []byte) {
+	if cache.ttl == 0 {
+		return
+	}
+	now := time.Now()
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if len(cache.entries) >= maxCacheEntries {
+		for key, entry := range cache.entries {
+			if now.After(entry.expires) {
+				delete(cache.entries, key)
+			}
+		}
+	}
+	// entries are made by the first response to keep
+	if cache.entries == nil || len(cache.entries) >= maxCacheEntries {
+		cache.entries = make(map[string]cacheEntry)
+	}
+	cache.entries[key] = cacheEntry{body: body, expires: now.Add(cache.ttl)}
+}
+
+// cacheKey keeps only declared params in declaration order,
+// so unknown params and their order do not split the cache
+func cacheKey(r *http.Request, names []string) string {
+	values := make([]string, 0, len(names))
+	for _, name := range names {
+		values = append(values, name+"="+url.QueryEscape(r.FormValue(name)))
+	}
+	return r.URL.Path + "?" + strings.Join(values, "&")
+}
+
+func writeCached(w http.ResponseWriter, r *http.Request, body []byte, cache *responseCache) {
+	if cache.maxAge > 0 {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(cache.maxAge))
+	}
+	if cache.etag {
+		sum := sha256.Sum256(body)
+		etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+		w.Header().Set("ETag", etag)
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// etagMatch uses the weak comparison required for If-None-Match
+func etagMatch(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+const maxBatchCalls = 50
+
+type batchCall struct {
+	URL    string          `json:"url"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type batchResult struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// batchRecorder collects the response of a single call of a batch
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *batchRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *batchRecorder) Write(data []byte) (int, error) {
+	return rec.body.Write(data)
+}
+
+func (rec *batchRecorder) WriteHeader(status int) {
+	rec.status = status
+}
+
+// serveBatch runs every call through serve, the same way as a separate request,
+// calls go one by one unless mode=parallel is passed
+func serveBatch(w http.ResponseWriter, r *http.Request, env envelope, serve http.HandlerFunc) {
+	if r.Method != http.MethodPost {
+		apiError := ApiError{Err: errors.New("bad method"), HTTPStatus: http.StatusNotAcceptable}
+		env.handleError(w, apiError)
+		return
+	}
+	var calls []batchCall
+	if err := json.NewDecoder(r.Body).Decode(&calls); nil != err {
+		if tooLarge(err) {
+			env.handleError(w, errTooLarge)
+			return
+		}
+		apiError := ApiError{Err: errors.New("batch must be an array of calls"), HTTPStatus: http.StatusBadRequest}
+		env.handleError(w, apiError)
+		return
+	}
+	if len(calls) > maxBatchCalls {
+		apiError := ApiError{Err: fmt.Errorf("batch must have <= %d calls", maxBatchCalls), HTTPStatus: http.StatusBadRequest}
+		env.handleError(w, apiError)
+		return
+	}
+	parallel := r.URL.Query().Get("mode") == "parallel"
+	results := make([]batchResult, len(calls))
+	wg := &sync.WaitGroup{}
+	for idx, call := range calls {
+		if !parallel {
+			results[idx] = runBatchCall(r, env, call, serve)
+			continue
+		}
+		wg.Add(1)
+		go func(idx int, call batchCall) {
+			defer wg.Done()
+			results[idx] = runBatchCall(r, env, call, serve)
+		}(idx, call)
+	}
+	wg.Wait()
+	env.handleResult(w, results)
+}
+
+func runBatchCall(r *http.Request, env envelope, call batchCall, serve http.HandlerFunc) batchResult {
+	rec := &batchRecorder{header: make(http.Header), status: http.StatusOK}
+	req, err := newBatchRequest(r, call)
+	if nil != err {
+		env.handleError(rec, err)
+	} else {
+		serve(rec, req)
+	}
+	result := batchResult{Status: rec.status, Body: rec.body.Bytes()}
+	if rec.body.Len() == 0 {
+		result.Body = json.RawMessage("null")
+	} else if !json.Valid(result.Body) {
+		result.Body, _ = json.Marshal(rec.body.String())
+	}
+	return result
+}
+
+func newBatchRequest(r *http.Request, call batchCall) (*http.Request, error) {
+	target, err := url.Parse(call.URL)
+	if nil != err || target.IsAbs() || target.Path == r.URL.Path {
+		return nil, ApiError{Err: errors.New("bad url"), HTTPStatus: http.StatusBadRequest}
+	}
+	params, err := newRPCParams(call.Params)
+	if nil != err {
+		return nil, ApiError{Err: errors.New("params must be an object"), HTTPStatus: http.StatusBadRequest}
+	}
+	values := target.Query()
+	for key, value := range params {
+		values.Set(key, value)
+	}
+	method := call.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if method == http.MethodGet {
+		target.RawQuery = values.Encode()
+	} else {
+		body = strings.NewReader(values.Encode())
+	}
+	req, err := http.NewRequest(method, target.String(), body)
+	if nil != err {
+		return nil, ApiError{Err: errors.New("bad method"), HTTPStatus: http.StatusBadRequest}
+	}
+	req = req.WithContext(r.Context())
+	req.Header = r.Header.Clone()
+	req.Header.Del("Content-Length")
+	req.Header.Del("Content-Type")
+	if nil != body {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return req, nil
+}
+
+// validationMessages are keyed by locale and rule, {param} and {value} are replaced
+// with the name of the param and the value of the rule
+var validationMessages = map[string]map[string]string{
+	"en": {
+		"required": "{param} must not be empty",
+		"type":     "{param} must be {value}",
+		"min":      "{param} must be >= {value}",
+		"max":      "{param} must be <= {value}",
+		"minlen":   "{param} length must be >= {value}",
+		"maxlen":   "{param} length must be <= {value}",
+		"enum":     "{param} must be one of [{value}]",
+		"maxsize":  "{param} size must be <= {value}",
+		"mime":     "{param} type must be one of [{value}]",
+	},
+	"ru": {
+		"required": "{param}: обязательный параметр",
+		"type":     "{param}: неверный тип, ожидается {value}",
+		"min":      "{param}: значение должно быть не меньше {value}",
+		"max":      "{param}: значение должно быть не больше {value}",
+		"minlen":   "{param}: длина должна быть не меньше {value}",
+		"maxlen":   "{param}: длина должна быть не больше {value}",
+		"enum":     "{param}: допустимые значения [{value}]",
+		"maxsize":  "{param}: размер должен быть не больше {value}",
+		"mime":     "{param}: тип файла должен быть одним из [{value}]",
+	},
+	// legacy keeps the wording of the first version of the api for clients
+	// which do not send Accept-Language and match the messages as they are
+	"": {
+		"required": "{param} must me not empty",
+		"type":     "{param} must be {value}",
+		"min":      "{param} must be >= {value}",
+		"max":      "{param} must be <= {value}",
+		"minlen":   "{param} len must be >= {value}",
+		"maxlen":   "{param} len must be <= {value}",
+		"enum":     "{param} must be one of [{value}]",
+		"maxsize":  "{param} size must be <= {value}",
+		"mime":     "{param} type must be one of [{value}]",
+	},
+}
+
+// requestLocale picks the catalog by Accept-Language, en is used for languages
+// without a catalog and the legacy messages when there is no header at all
+func requestLocale(r *http.Request) string {
+	header := r.Header.Get("Accept-Language")
+	if header == "" {
+		return ""
+	}
+	locale, weight := "en", 0.0
+	for _, item := range strings.Split(header, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ";")
+		lang := strings.ToLower(strings.SplitN(parts[0], "-", 2)[0])
+		if _, ok := validationMessages[lang]; !ok || lang == "" {
+			continue
+		}
+		q := 1.0
+		if len(parts) > 1 && strings.HasPrefix(strings.TrimSpace(parts[1]), "q=") {
+			q, _ = strconv.ParseFloat(strings.TrimSpace(parts[1])[2:], 64)
+		}
+		if q > weight {
+			locale, weight = lang, q
+		}
+	}
+	return locale
+}
+
+func validationError(locale string, rule string, param string, value string, overrides map[string]string) error {
+	message, ok := overrides[locale+"."+rule]
+	if !ok {
+		message, ok = overrides[rule]
+	}
+	if !ok {
+		message = validationMessages[locale][rule]
+	}
+	message = strings.NewReplacer("{param}", param, "{value}", value).Replace(message)
+	return ApiError{Err: errors.New(message), HTTPStatus: http.StatusBadRequest}
+}
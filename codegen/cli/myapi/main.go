@@ -0,0 +1,282 @@
+package main
+import "bytes"
+import "encoding/json"
+import "flag"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "mime/multipart"
+import "net/http"
+import "net/url"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+
+const cliName = "myapi"
+
+var cliCommands = []cliCommand{
+	{
+		name: "profile",
+		url: "/user/profile",
+		method: "GET",
+		envelope: "legacy",
+		params: []cliParam{
+			{name: "login", kind: "string", value: "", usage: "required"},
+		},
+	},
+	{
+		name: "profilev2",
+		url: "/v2/user/profile",
+		method: "GET",
+		envelope: "legacy",
+		params: []cliParam{
+			{name: "login", kind: "string", value: "", usage: "required"},
+		},
+	},
+	{
+		name: "create",
+		url: "/user/create",
+		method: "POST",
+		envelope: "legacy",
+		params: []cliParam{
+			{name: "login", kind: "string", value: "", usage: "required, len >= 10"},
+			{name: "full_name", kind: "string", value: "", usage: ""},
+			{name: "status", kind: "string", value: "user", usage: "one of user|moderator|admin"},
+			{name: "age", kind: "int", value: "", usage: ">= 0, <= 128"},
+		},
+	},
+	{
+		name: "list",
+		url: "/user/list",
+		method: "GET",
+		stream: true,
+		envelope: "legacy",
+		params: []cliParam{
+			{name: "limit", kind: "int", value: "100", usage: ">= 1, <= 100"},
+			{name: "status", kind: "string", value: "all", usage: "one of user|moderator|admin|all"},
+			{name: "login.prefix", kind: "string", value: "", usage: "len <= 32"},
+			{name: "login.suffix", kind: "string", value: "", usage: "len <= 32"},
+		},
+	},
+	{
+		name: "uploadavatar",
+		url: "/user/avatar",
+		method: "POST",
+		envelope: "legacy",
+		params: []cliParam{
+			{name: "login", kind: "string", value: "", usage: "required"},
+			{name: "avatar", kind: "file", value: "", usage: "`path` of the file, required, size <= 1MB, type image/png|image/jpeg"},
+		},
+	},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	global := flag.NewFlagSet(cliName, flag.ContinueOnError)
+	global.SetOutput(stderr)
+	addr := global.String("addr", envOr("APICLI_ADDR", "http://127.0.0.1:8080"), "api server address")
+	auth := global.String("auth", os.Getenv("APICLI_AUTH"), "token sent in X-Auth")
+	global.Usage = func() {
+		fmt.Fprintf(stderr, "usage: %s [flags] <command> [command flags]\n\ncommands:\n", cliName)
+		for _, command := range cliCommands {
+			fmt.Fprintf(stderr, "  %-12s %-5s %s\n", command.name, command.method, command.url)
+		}
+		fmt.Fprintln(stderr, "\nflags:")
+		global.PrintDefaults()
+	}
+	if err := global.Parse(args); nil != err {
+		return exitCode(err)
+	}
+	if global.NArg() == 0 {
+		global.Usage()
+		return 2
+	}
+
+	command, ok := findCommand(global.Arg(0))
+	if !ok {
+		fmt.Fprintf(stderr, "%s: unknown command %q\n", cliName, global.Arg(0))
+		global.Usage()
+		return 2
+	}
+	fs := command.flagSet(stderr)
+	if err := fs.Parse(global.Args()[1:]); nil != err {
+		return exitCode(err)
+	}
+
+	req, err := command.request(*addr, fs)
+	if nil != err {
+		fmt.Fprintf(stderr, "%s: %v\n", cliName, err)
+		return 1
+	}
+	if *auth != "" {
+		req.Header.Set("X-Auth", *auth)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if nil != err {
+		fmt.Fprintf(stderr, "%s: %v\n", cliName, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	return command.print(resp, stdout, stderr)
+}
+
+func envOr(key string, value string) string {
+	if env := os.Getenv(key); env != "" {
+		return env
+	}
+	return value
+}
+
+func exitCode(err error) int {
+	if err == flag.ErrHelp {
+		return 0
+	}
+	return 2
+}
+
+func findCommand(name string) (cliCommand, bool) {
+	for _, command := range cliCommands {
+		if command.name == name {
+			return command, true
+		}
+	}
+	return cliCommand{}, false
+}
+
+type cliParam struct {
+	name string
+	// kind is int, string or file
+	kind  string
+	value string
+	usage string
+}
+
+type cliCommand struct {
+	name   string
+	url    string
+	method string
+	stream bool
+	// envelope is legacy, bare or problem
+	envelope string
+	params   []cliParam
+}
+
+func (command cliCommand) flagSet(stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(cliName+" "+command.name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	for _, param := range command.params {
+		switch param.kind {
+		case "int":
+			value, _ := strconv.Atoi(param.value)
+			fs.Int(param.name, value, param.usage)
+		default:
+			fs.String(param.name, param.value, param.usage)
+		}
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: %s %s [flags]\n\n%s %s\n\nflags:\n", cliName, command.name, command.method, command.url)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// request sends only the flags given on the command line,
+// defaults are applied by the server
+func (command cliCommand) request(addr string, fs *flag.FlagSet) (*http.Request, error) {
+	values := url.Values{}
+	files := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		for _, param := range command.params {
+			if param.name != f.Name {
+				continue
+			}
+			if param.kind == "file" {
+				files[f.Name] = f.Value.String()
+			} else {
+				values.Set(f.Name, f.Value.String())
+			}
+		}
+	})
+
+	target := strings.TrimRight(addr, "/") + command.url
+	if command.method == http.MethodGet {
+		return http.NewRequest(http.MethodGet, target+"?"+values.Encode(), nil)
+	}
+	if len(files) == 0 {
+		req, err := http.NewRequest(command.method, target, strings.NewReader(values.Encode()))
+		if nil != err {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	}
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for key := range values {
+		form.WriteField(key, values.Get(key))
+	}
+	for key, path := range files {
+		data, err := ioutil.ReadFile(path)
+		if nil != err {
+			return nil, err
+		}
+		part, err := form.CreateFormFile(key, filepath.Base(path))
+		if nil != err {
+			return nil, err
+		}
+		part.Write(data)
+	}
+	if err := form.Close(); nil != err {
+		return nil, err
+	}
+	req, err := http.NewRequest(command.method, target, body)
+	if nil != err {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req, nil
+}
+
+// print writes the decoded response to stdout, or the ApiError message to stderr
+func (command cliCommand) print(resp *http.Response, stdout io.Writer, stderr io.Writer) int {
+	if command.stream && resp.StatusCode == http.StatusOK {
+		io.Copy(stdout, resp.Body)
+		return 0
+	}
+
+	var response map[string]interface{}
+	var result interface{}
+	data, err := ioutil.ReadAll(resp.Body)
+	if nil == err {
+		err = json.Unmarshal(data, &result)
+	}
+	if nil != err {
+		fmt.Fprintf(stderr, "%s: %s\n", cliName, resp.Status)
+		return 1
+	}
+	response, _ = result.(map[string]interface{})
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := response["error"].(string)
+		if command.envelope == "problem" {
+			message, _ = response["detail"].(string)
+		}
+		if message == "" {
+			message = resp.Status
+		}
+		fmt.Fprintf(stderr, "%s: %s\n", cliName, message)
+		return 1
+	}
+
+	if command.envelope == "legacy" {
+		result = response["response"]
+	}
+	data, _ = json.MarshalIndent(result, "", "  ")
+	fmt.Fprintln(stdout, string(data))
+	return 0
+}
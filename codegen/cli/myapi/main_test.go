@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// сервер проверяет запрос клиента и отвечает как сгенерированный хендлер
+func cliTestServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/user/profile":
+			if r.Method != http.MethodGet || r.URL.Query().Get("login") != "rvasily" {
+				t.Errorf("bad profile request: %s %s", r.Method, r.URL)
+			}
+			w.Write([]byte(`{"error": "", "response": {"id": 42, "login": "rvasily"}}`))
+		case "/user/create":
+			r.ParseForm()
+			if r.Header.Get("X-Auth") != "100500" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"error": "unauthorized"}`))
+				return
+			}
+			// значения по умолчанию подставляет сервер, клиент их не шлёт
+			if _, ok := r.PostForm["status"]; ok || r.PostForm.Get("age") != "32" {
+				t.Errorf("bad create form: %v", r.PostForm)
+			}
+			w.Write([]byte(`{"error": "", "response": {"id": 43}}`))
+		case "/user/list":
+			w.Write([]byte("{\"id\":42}\n{\"id\":43}\n"))
+		case "/user/avatar":
+			file, header, err := r.FormFile("avatar")
+			if nil != err {
+				t.Errorf("no avatar: %v", err)
+				return
+			}
+			data, _ := ioutil.ReadAll(file)
+			if string(data) != "png" || header.Filename != "avatar.png" || r.FormValue("login") != "rvasily" {
+				t.Errorf("bad avatar upload: %q %q", data, header.Filename)
+			}
+			w.Write([]byte(`{"error": "", "response": {"login": "rvasily", "size": 3}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": "unknown method"}`))
+		}
+	}))
+}
+
+func TestCLI(t *testing.T) {
+	ts := cliTestServer(t)
+	defer ts.Close()
+
+	avatar := filepath.Join(t.TempDir(), "avatar.png")
+	if err := ioutil.WriteFile(avatar, []byte("png"), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Args   []string
+		Code   int
+		Stdout string
+		Stderr string
+	}{
+		{
+			Args:   []string{"profile", "--login", "rvasily"},
+			Stdout: "{\n  \"id\": 42,\n  \"login\": \"rvasily\"\n}\n",
+		},
+		{ // сообщение ApiError и ненулевой код выхода
+			Args:   []string{"create", "--login", "mr.moderator", "--age", "32"},
+			Code:   1,
+			Stderr: "myapi: unauthorized\n",
+		},
+		{
+			Args:   []string{"-auth", "100500", "create", "--login", "mr.moderator", "--age", "32"},
+			Stdout: "{\n  \"id\": 43\n}\n",
+		},
+		{ // поток печатается как есть
+			Args:   []string{"list"},
+			Stdout: "{\"id\":42}\n{\"id\":43}\n",
+		},
+		{
+			Args:   []string{"-auth", "100500", "uploadavatar", "--login", "rvasily", "--avatar", avatar},
+			Stdout: "{\n  \"login\": \"rvasily\",\n  \"size\": 3\n}\n",
+		},
+		{
+			Args:   []string{"create", "--age", "old"},
+			Code:   2,
+			Stderr: "invalid value \"old\" for flag -age",
+		},
+		{
+			Args:   []string{"delete"},
+			Code:   2,
+			Stderr: "myapi: unknown command \"delete\"",
+		},
+		{ // в подсказке видны обязательные поля, варианты enum и значения по умолчанию
+			Args:   []string{"create", "--help"},
+			Stderr: "required, len >= 10\n  -status string\n    \tone of user|moderator|admin (default \"user\")\n",
+		},
+	}
+
+	for idx, item := range cases {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		code := run(append([]string{"-addr", ts.URL}, item.Args...), stdout, stderr)
+		if code != item.Code {
+			t.Errorf("[%d] expected exit code %d, got %d: %s", idx, item.Code, code, stderr)
+		}
+		if stdout.String() != item.Stdout {
+			t.Errorf("[%d] expected stdout %q, got %q", idx, item.Stdout, stdout)
+		}
+		if !strings.Contains(stderr.String(), item.Stderr) {
+			t.Errorf("[%d] expected stderr to contain %q, got %q", idx, item.Stderr, stderr)
+		}
+	}
+}
+
+func TestCLIEnv(t *testing.T) {
+	ts := cliTestServer(t)
+	defer ts.Close()
+
+	os.Setenv("APICLI_ADDR", ts.URL)
+	defer os.Unsetenv("APICLI_ADDR")
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if code := run([]string{"profile", "--login", "rvasily"}, stdout, stderr); code != 0 {
+		t.Errorf("expected exit code 0, got %d: %s", code, stderr)
+	}
+}
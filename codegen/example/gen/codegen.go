@@ -1,55 +1,604 @@
 // go build gen/* && ./codegen.exe pack/unpack.go  pack/marshaller.go
-// go run pack/*
+// go run ./pack
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"go/ast"
+	"go/format"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"log"
 	"os"
+	"path"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 )
 
 type tpl struct {
-	FieldName string
+	// Expr is the value being read or written: in.ID, in.Tags[i0]
+	Expr string
+	// Var prefixes the local variables of the value
+	Var  string
+	Type string
+	// Field is the expression naming the value in errors
+	Field string
+	// Order is the byte order of the value, LittleEndian or BigEndian
+	Order string
+	// Size is the number of bytes of a fixed value, Min is the least
+	// number of bytes of an element of a slice
+	Size string
+	Min  int
+	// LenType, LenSize and LenMax describe a fixed width length prefix
+	LenType   string
+	LenSize   int
+	LenMax    string
+	LenVarint bool
+	// Signed varints are zigzag encoded, Range is the condition
+	// of a decoded varint not fitting the type
+	Signed bool
+	Range  string
+	// Pad is the padding of a string of Size bytes: a keeps the zero bytes,
+	// A pads with spaces, Z leaves room for the terminating zero
+	Pad string
+	// Read is the expression of a fixed value at data[off:],
+	// Bytes is set for single byte elements which are copied at once
+	Read    string
+	LenRead string
+	Bytes   bool
+	// Index is the loop variable over the elements, Elem is their code
+	Index string
+	Elem  string
 }
 
 var (
-	intTpl = template.Must(template.New("intTpl").Parse(`
-	// {{.FieldName}}
-	var {{.FieldName}}Raw uint32
-	binary.Read(r, binary.LittleEndian, &{{.FieldName}}Raw)
-	in.{{.FieldName}} = int({{.FieldName}}Raw)
+	// every read is preceded by the check of the rest of data,
+	// so a length prefix never allocates more than data can fill
+	intTpl = template.Must(template.New("intTpl").Parse(`	if len(data)-off < 4 {
+		return off, unpackError({{.Field}}, off, ErrTruncated)
+	}
+	{{.Expr}} = {{.Type}}(binary.{{.Order}}.Uint32(data[off:]))
+	off += 4
 `))
 
-	strTpl = template.Must(template.New("strTpl").Parse(`
-	// {{.FieldName}}
-	var {{.FieldName}}LenRaw uint32
-	binary.Read(r, binary.LittleEndian, &{{.FieldName}}LenRaw)
-	{{.FieldName}}Raw := make([]byte, {{.FieldName}}LenRaw)
-	binary.Read(r, binary.LittleEndian, &{{.FieldName}}Raw)
-	in.{{.FieldName}} = string({{.FieldName}}Raw)
+	fixedTpl = template.Must(template.New("fixedTpl").Parse(`	if len(data)-off < {{.Size}} {
+		return off, unpackError({{.Field}}, off, ErrTruncated)
+	}
+	{{.Expr}} = {{.Read}}
+	off += {{.Size}}
+`))
+
+	// fixedElemsTpl fills the elements of a fixed array or of a slice
+	// made by fixedSliceTpl, the length is checked by the caller
+	fixedElemsTpl = template.Must(template.New("fixedElemsTpl").Parse(`{{if .Bytes}}	copy({{.Expr}}[:], data[off:])
+	off += len({{.Expr}})
+{{else}}	for {{.Index}} := range {{.Expr}} {
+		{{.Expr}}[{{.Index}}] = {{.Read}}
+		off += {{.Min}}
+	}
+{{end}}`))
+
+	fixedArrayTpl = template.Must(template.New("fixedArrayTpl").Parse(`	if len(data)-off < {{.Size}} {
+		return off, unpackError({{.Field}}, off, ErrTruncated)
+	}
+{{template "fixedElemsTpl" .}}`))
+
+	lenTpl = template.Must(template.New("lenTpl").Parse(`{{if .LenVarint}}	{{.Var}}LenRaw, {{.Var}}LenSize := binary.Uvarint(data[off:])
+	if {{.Var}}LenSize <= 0 {
+		return off, unpackError({{.Field}}, off, varintError({{.Var}}LenSize))
+	}
+	off += {{.Var}}LenSize
+{{else}}	if len(data)-off < {{.LenSize}} {
+		return off, unpackError({{.Field}}, off, ErrTruncated)
+	}
+	{{.Var}}LenRaw := {{.LenRead}}
+	off += {{.LenSize}}
+{{end}}{{if .Min}}	if uint64({{.Var}}LenRaw) > uint64(len(data)-off){{if ne .Min 1}}/{{.Min}}{{end}} {
+		return off, unpackError({{.Field}}, off, ErrTruncated)
+	}
+{{end}}`))
+
+	varintTpl = template.Must(template.New("varintTpl").Parse(`	{{.Var}}Raw, {{.Var}}Size := binary.{{if .Signed}}Varint{{else}}Uvarint{{end}}(data[off:])
+	if {{.Var}}Size <= 0 {
+		return off, unpackError({{.Field}}, off, varintError({{.Var}}Size))
+	}
+{{if .Range}}	if {{.Range}} {
+		return off, unpackError({{.Field}}, off, ErrOverflow)
+	}
+{{end}}	{{.Expr}} = {{.Type}}({{.Var}}Raw)
+	off += {{.Var}}Size
+`))
+
+	// with alias set strings and []byte share memory with data
+	strTpl = template.Must(template.New("strTpl").Parse(`{{template "lenTpl" .}}	if alias {
+		{{.Expr}} = unsafeString(data[off : off+int({{.Var}}LenRaw)])
+	} else {
+		{{.Expr}} = string(data[off : off+int({{.Var}}LenRaw)])
+	}
+	off += int({{.Var}}LenRaw)
+`))
+
+	bytesTpl = template.Must(template.New("bytesTpl").Parse(`{{template "lenTpl" .}}	if alias {
+		{{.Expr}} = data[off : off+int({{.Var}}LenRaw) : off+int({{.Var}}LenRaw)]
+	} else {
+		{{.Expr}} = make([]byte, {{.Var}}LenRaw)
+		copy({{.Expr}}, data[off:])
+	}
+	off += int({{.Var}}LenRaw)
+`))
+
+	// padded strings end at the first zero byte, like C strings
+	paddedStrTpl = template.Must(template.New("paddedStrTpl").Parse(`	if len(data)-off < {{.Size}} {
+		return off, unpackError({{.Field}}, off, ErrTruncated)
+	}
+	{{.Var}}Raw := data[off : off+{{.Size}}]
+{{if eq .Pad "A"}}	{{.Var}}Raw = bytes.TrimRight({{.Var}}Raw, "\x00 \t\n\r")
+{{else if ne .Pad "a"}}	if end := bytes.IndexByte({{.Var}}Raw, 0); end >= 0 {
+		{{.Var}}Raw = {{.Var}}Raw[:end]
+	}
+{{end}}	if alias {
+		{{.Expr}} = unsafeString({{.Var}}Raw)
+	} else {
+		{{.Expr}} = string({{.Var}}Raw)
+	}
+	off += {{.Size}}
+`))
+
+	paddedBytesTpl = template.Must(template.New("paddedBytesTpl").Parse(`	if len(data)-off < {{.Size}} {
+		return off, unpackError({{.Field}}, off, ErrTruncated)
+	}
+	if alias {
+		{{.Expr}} = data[off : off+{{.Size}} : off+{{.Size}}]
+	} else {
+		{{.Expr}} = make([]byte, {{.Size}})
+		copy({{.Expr}}, data[off:])
+	}
+	off += {{.Size}}
+`))
+
+	fixedSliceTpl = template.Must(template.New("fixedSliceTpl").Parse(`{{template "lenTpl" .}}	{{.Expr}} = make({{.Type}}, {{.Var}}LenRaw)
+{{template "fixedElemsTpl" .}}`))
+
+	sliceTpl = template.Must(template.New("sliceTpl").Parse(`{{template "lenTpl" .}}	{{.Expr}} = make({{.Type}}, {{.Var}}LenRaw)
+	for {{.Index}} := range {{.Expr}} {
+{{.Elem}}	}
+`))
+
+	arrayTpl = template.Must(template.New("arrayTpl").Parse(`	for {{.Index}} := range {{.Expr}} {
+{{.Elem}}	}
+`))
+
+	structTpl = template.Must(template.New("structTpl").Parse(`	{{.Var}}End, err := {{.Expr}}.unpackFrom(data, off, alias)
+	if nil != err {
+		return {{.Var}}End, unpackError({{.Field}}, off, err)
+	}
+	off = {{.Var}}End
+`))
+
+	packIntTpl = template.Must(template.New("packIntTpl").Parse(`	if {{if eq .Type "int"}}{{.Expr}} < 0 || {{end}}uint64({{.Expr}}) > math.MaxUint32 {
+		return fmt.Errorf("{{.Var}}: %d does not fit uint32", {{.Expr}})
+	}
+	binary.Write(w, binary.{{.Order}}, uint32({{.Expr}}))
+`))
+
+	packVarintTpl = template.Must(template.New("packVarintTpl").Parse(`{{if .Signed}}	writeVarint(w, int64({{.Expr}}))
+{{else}}	writeUvarint(w, uint64({{.Expr}}))
+{{end}}`))
+
+	packFixedTpl = template.Must(template.New("packFixedTpl").Parse(`	binary.Write(w, binary.{{.Order}}, {{.Expr}})
+`))
+
+	packLenTpl = template.Must(template.New("packLenTpl").Parse(`{{if .LenVarint}}	writeUvarint(w, uint64(len({{.Expr}})))
+{{else}}	if uint64(len({{.Expr}})) > {{.LenMax}} {
+		return fmt.Errorf("{{.Var}}: length %d does not fit {{.LenType}}", len({{.Expr}}))
+	}
+	binary.Write(w, binary.{{.Order}}, {{.LenType}}(len({{.Expr}})))
+{{end}}`))
+
+	packStrTpl = template.Must(template.New("packStrTpl").Parse(`{{template "packLenTpl" .}}	w.WriteString({{.Expr}})
+`))
+
+	packPaddedTpl = template.Must(template.New("packPaddedTpl").Parse(`	if len({{.Expr}}) {{if eq .Pad "Z"}}>={{else}}>{{end}} {{.Size}} {
+		return fmt.Errorf("{{.Var}}: length %d does not fit {{.Size}} bytes{{if eq .Pad "Z"}} with the terminating zero{{end}}", len({{.Expr}}))
+	}
+	w.{{if eq .Type "string"}}WriteString{{else}}Write{{end}}({{.Expr}})
+{{if eq .Pad "A"}}	w.Write(bytes.Repeat([]byte{' '}, {{.Size}}-len({{.Expr}})))
+{{else}}	w.Write(make([]byte, {{.Size}}-len({{.Expr}})))
+{{end}}`))
+
+	packFixedSliceTpl = template.Must(template.New("packFixedSliceTpl").Parse(`{{template "packLenTpl" .}}	binary.Write(w, binary.{{.Order}}, {{.Expr}})
+`))
+
+	packSliceTpl = template.Must(template.New("packSliceTpl").Parse(`{{template "packLenTpl" .}}	for {{.Index}} := range {{.Expr}} {
+{{.Elem}}	}
+`))
+
+	packStructTpl = template.Must(template.New("packStructTpl").Parse(`	if err := {{.Expr}}.packTo(w); nil != err {
+		return err
+	}
 `))
 )
 
+// runtimeCode is emitted once, before the methods
+const runtimeCode = `
+// ErrTruncated is the error of data ending inside a field
+var ErrTruncated = errors.New("truncated data")
+
+// ErrOverflow is the error of a varint not fitting the field
+var ErrOverflow = errors.New("value overflows the field")
+
+// ErrTrailingBytes is the error of UnpackStrict when data has bytes after the last field
+var ErrTrailingBytes = errors.New("trailing bytes")
+
+// UnpackError tells which field failed and where
+type UnpackError struct {
+	// Field is the path of the field, like Guests[1].Login
+	Field  string
+	Offset int64
+	Err    error
+}
+
+func (e *UnpackError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("unpack at offset %d: %v", e.Offset, e.Err)
+	}
+	return fmt.Sprintf("unpack %s at offset %d: %v", e.Field, e.Offset, e.Err)
+}
+
+func (e *UnpackError) Unwrap() error {
+	return e.Err
+}
+
+// unpackError puts the field in front of the path of the error of a nested struct
+func unpackError(field string, off int, err error) error {
+	if nested, ok := err.(*UnpackError); ok {
+		if nested.Field == "" {
+			nested.Field = field
+		} else {
+			nested.Field = field + "." + nested.Field
+		}
+		return nested
+	}
+	return &UnpackError{Field: field, Offset: int64(off), Err: err}
+}
+
+// varintError is the error of the size returned by binary.Uvarint and binary.Varint
+func varintError(size int) error {
+	if size == 0 {
+		return ErrTruncated
+	}
+	return ErrOverflow
+}
+
+// unsafeString is the string sharing memory with b
+func unsafeString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return unsafe.String(&b[0], len(b))
+}
+
+func writeUvarint(w *bytes.Buffer, value uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], value)])
+}
+
+func writeVarint(w *bytes.Buffer, value int64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutVarint(buf[:], value)])
+}
+
+// fieldHeader reads the number and the length of the field of a tagged struct at data[off:]
+// and returns the offsets of its value, number 0 ends the struct
+func fieldHeader(data []byte, off int) (uint64, int, int, error) {
+	id, size := binary.Uvarint(data[off:])
+	if size <= 0 {
+		return 0, off, off, &UnpackError{Offset: int64(off), Err: varintError(size)}
+	}
+	off += size
+	if id == 0 {
+		return 0, off, off, nil
+	}
+	length, size := binary.Uvarint(data[off:])
+	if size <= 0 {
+		return 0, off, off, &UnpackError{Offset: int64(off), Err: varintError(size)}
+	}
+	off += size
+	if length > uint64(len(data)-off) {
+		return 0, off, off, &UnpackError{Offset: int64(off), Err: ErrTruncated}
+	}
+	return id, off, off + int(length), nil
+}
+
+// endField puts the length of the field value written to w after start in front of it
+func endField(w *bytes.Buffer, start int) {
+	var prefix [binary.MaxVarintLen64]byte
+	size := binary.PutUvarint(prefix[:], uint64(w.Len()-start))
+	w.Write(prefix[:size])
+	b := w.Bytes()
+	copy(b[start+size:], b[start:len(b)-size])
+	copy(b[start:], prefix[:size])
+}
+
+// MaxFrameSize limits the length of a frame read by DecodeFrom and FrameReader,
+// so a corrupted length prefix does not allocate gigabytes
+var MaxFrameSize = 64 << 20
+
+// ErrFrameTooLarge is the error of a frame longer than MaxFrameSize
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// Record is a struct marked with cgen: binpack
+type Record interface {
+	packTo(w *bytes.Buffer) error
+	unpackFrom(data []byte, off int, alias bool) (int, error)
+}
+
+// writeFrame writes rec to w in one call, after its length as uvarint,
+// buf is reused between the records
+func writeFrame(w io.Writer, rec Record, buf *bytes.Buffer) error {
+	var prefix [binary.MaxVarintLen64]byte
+	buf.Reset()
+	buf.Write(prefix[:])
+	if err := rec.packTo(buf); nil != err {
+		return err
+	}
+	frame := buf.Bytes()
+	size := binary.PutUvarint(prefix[:], uint64(len(frame)-len(prefix)))
+	frame = frame[len(prefix)-size:]
+	copy(frame, prefix[:size])
+	_, err := w.Write(frame)
+	return err
+}
+
+type frameSource interface {
+	io.Reader
+	io.ByteReader
+}
+
+// byteReader reads the length prefix of a frame one byte at a time,
+// so nothing after the frame is taken from the reader
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+// readFrame reads the next frame from r into rec, buf is reused between the frames,
+// io.EOF tells the stream ended before the frame
+func readFrame(r frameSource, rec Record, buf []byte) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if nil != err {
+		return buf, err
+	}
+	if size > uint64(MaxFrameSize) {
+		return buf, ErrFrameTooLarge
+	}
+	if uint64(cap(buf)) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	if _, err := io.ReadFull(r, buf); nil != err {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return buf, err
+	}
+	off, err := rec.unpackFrom(buf, 0, false)
+	if nil != err {
+		return buf, err
+	}
+	if off < len(buf) {
+		return buf, &UnpackError{Offset: int64(off), Err: ErrTrailingBytes}
+	}
+	return buf, nil
+}
+
+// FrameWriter writes a sequence of records, each one after its length as uvarint
+type FrameWriter struct {
+	w   *bufio.Writer
+	buf bytes.Buffer
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: bufio.NewWriter(w)}
+}
+
+// Encode writes rec as the next frame, it is buffered until Flush
+func (fw *FrameWriter) Encode(rec Record) error {
+	return writeFrame(fw.w, rec, &fw.buf)
+}
+
+func (fw *FrameWriter) Flush() error {
+	return fw.w.Flush()
+}
+
+// FrameReader reads the records written by FrameWriter or EncodeTo,
+// only the current one is kept in memory
+type FrameReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next frame into rec, io.EOF tells there are no more frames
+func (fr *FrameReader) Decode(rec Record) error {
+	var err error
+	fr.buf, err = readFrame(fr.r, rec, fr.buf)
+	return err
+}
+`
+
+// fixedTypes are written as is by encoding/binary, the value is their size
+var fixedTypes = map[string]int{
+	"int8": 1, "int16": 2, "int32": 4, "int64": 8,
+	"uint8": 1, "uint16": 2, "uint32": 4, "uint64": 8,
+	"byte": 1, "float32": 4, "float64": 8, "bool": 1,
+}
+
+type intRange struct {
+	Signed bool
+	// Min and Max are the bounds of the type narrower than 64 bits
+	Min string
+	Max string
+}
+
+// varintTypes are the types encoded with varints in the varint mode,
+// single bytes gain nothing and stay as they are
+var varintTypes = map[string]intRange{
+	"int":    {true, "math.MinInt", "math.MaxInt"},
+	"int16":  {true, "math.MinInt16", "math.MaxInt16"},
+	"int32":  {true, "math.MinInt32", "math.MaxInt32"},
+	"int64":  {true, "", ""},
+	"uint":   {false, "", "math.MaxUint"},
+	"uint16": {false, "", "math.MaxUint16"},
+	"uint32": {false, "", "math.MaxUint32"},
+	"uint64": {false, "", ""},
+}
+
+type lenPrefix struct {
+	Type string
+	Size int
+	Max  string
+}
+
+// lenPrefixes are the fixed width length prefixes, len=varint is the other one
+var lenPrefixes = map[string]lenPrefix{
+	"u8":  {"uint8", 1, "math.MaxUint8"},
+	"u16": {"uint16", 2, "math.MaxUint16"},
+	"u32": {"uint32", 4, "math.MaxUint32"},
+}
+
+// readExpr is the expression of the fixed value of type name at data[off:]
+func readExpr(name string, order string) string {
+	switch name {
+	case "uint8", "byte":
+		return "data[off]"
+	case "int8":
+		return "int8(data[off])"
+	case "bool":
+		return "data[off] != 0"
+	case "float32", "float64":
+		imports["math"] = true
+		bits := strconv.Itoa(fixedTypes[name] * 8)
+		return "math.Float" + bits + "frombits(binary." + order + ".Uint" + bits + "(data[off:]))"
+	}
+	read := "binary." + order + ".Uint" + strconv.Itoa(fixedTypes[name]*8) + "(data[off:])"
+	if strings.HasPrefix(name, "int") {
+		return name + "(" + read + ")"
+	}
+	return read
+}
+
+// options are the wire options of a value,
+// set by the cgen tag of the field or by the cgen: binpack directive of the struct
+type options struct {
+	Order string
+	Len   string
+	// Size is the size of a string or []byte padded with zero bytes
+	Size int
+	// Varint encodes integers with varints, signed ones with zigzag
+	Varint bool
+	// ID is the number of the field in a tagged struct, Default is its value
+	// when data has no such field
+	ID      int
+	Default string
+	// Reserved are the numbers of the removed fields of a tagged struct
+	Reserved []int
+	// Pad is the padding of the pack template letters a, A and Z
+	Pad string
+}
+
+var defaultOptions = options{Order: "LittleEndian", Len: "u32"}
+
+var (
+	// binpackStructs are the structs marked with cgen: binpack
+	binpackStructs = map[string]*ast.StructType{}
+	// structOptions are the defaults of the fields of the structs
+	structOptions = map[string]options{}
+	// structTemplates are the pack templates of the structs, like L L/a* L
+	structTemplates = map[string][]packItem{}
+	// imports are the packages used by the generated code
+	imports = map[string]bool{"bufio": true, "bytes": true, "encoding/binary": true, "errors": true, "fmt": true, "io": true, "unsafe": true}
+)
+
+func init() {
+	for _, t := range []*template.Template{strTpl, bytesTpl, fixedSliceTpl, sliceTpl} {
+		template.Must(t.AddParseTree("lenTpl", lenTpl.Tree))
+	}
+	for _, t := range []*template.Template{fixedArrayTpl, fixedSliceTpl} {
+		template.Must(t.AddParseTree("fixedElemsTpl", fixedElemsTpl.Tree))
+	}
+	for _, t := range []*template.Template{packStrTpl, packFixedSliceTpl, packSliceTpl} {
+		template.Must(t.AddParseTree("packLenTpl", packLenTpl.Tree))
+	}
+}
+
+type field struct {
+	Name string
+	Type ast.Expr
+	Opts options
+}
+
+var (
+	templateFlag = flag.String("template", "", "generate the struct of the pack `template`, like \"L L/a* L\"")
+	typeFlag     = flag.String("type", "Packed", "name of the struct generated from -template")
+	fieldsFlag   = flag.String("fields", "", "comma separated field names of the struct generated from -template, F1, F2 and so on by default")
+	packageFlag  = flag.String("package", "main", "package of the file generated from -template")
+	schemaFlag   = flag.String("schema", "", "write the JSON schema, the Python decoder and the Kaitai Struct description of every struct to `dir`")
+)
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: codegen [-schema dir] input.go output.go")
+		fmt.Fprintln(os.Stderr, "       codegen -template \"L L/a* L\" [-type User] [-fields ID,Login,Flags] [-package main] output.go")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// the struct of -template is parsed like the one written by hand
+	// and is put into the output file with its code
+	var input, decl string
+	var src interface{}
+	switch {
+	case *templateFlag != "" && flag.NArg() == 1:
+		input = "template"
+		if runtimeNames()[*typeFlag] {
+			log.Fatalln("-type", *typeFlag, "is taken by the runtime code of the generated file")
+		}
+		decl = templateStruct(*typeFlag, *fieldsFlag, *templateFlag)
+		src = "package " + *packageFlag + "\n" + decl
+	case *templateFlag == "" && flag.NArg() == 2:
+		input = flag.Arg(0)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	fset := token.NewFileSet()
-	node, err := parser.ParseFile(fset, os.Args[1], nil, parser.ParseComments)
+	node, err := parser.ParseFile(fset, input, src, parser.ParseComments)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	out, _ := os.Create(os.Args[2])
+	out, _ := os.Create(flag.Arg(flag.NArg() - 1))
 
-	fmt.Fprintln(out, `package `+node.Name.Name)
-	fmt.Fprintln(out) // empty line
-	fmt.Fprintln(out, `import "encoding/binary"`)
-	fmt.Fprintln(out, `import "bytes"`)
-	fmt.Fprintln(out) // empty line
+	// nested structs may be declared after the struct using them,
+	// so all marked structs are collected before generating
+	var structNames []string
 
 	for _, f := range node.Decls {
 		g, ok := f.(*ast.GenDecl)
@@ -77,52 +626,782 @@ func main() {
 			}
 
 			needCodegen := false
+			opts := defaultOptions
 			for _, comment := range g.Doc.List {
-				needCodegen = needCodegen || strings.HasPrefix(comment.Text, "// cgen: binpack")
+				if strings.HasPrefix(comment.Text, "// cgen: binpack") {
+					needCodegen = true
+					directive := strings.TrimPrefix(comment.Text, "// cgen: binpack")
+					// cgen: binpack template="L L/a* L"
+					if match := templateOption.FindStringSubmatch(directive); match != nil {
+						if strings.TrimSpace(strings.Replace(directive, match[0], "", 1)) != "" {
+							log.Fatalln("template defines the whole layout of struct", currType.Name.Name)
+						}
+						structTemplates[currType.Name.Name] = parseTemplate(match[1])
+						continue
+					}
+					// cgen: binpack be len=u16
+					opts = parseOptions(defaultOptions, strings.Fields(directive))
+				}
 			}
 			if !needCodegen {
 				fmt.Printf("SKIP struct %#v doesnt have cgen mark\n", currType.Name.Name)
 				continue SPECS_LOOP
 			}
+			if opts.Size > 0 || opts.ID > 0 || opts.Default != "" {
+				log.Fatalln("size, id and default are options of a field, not of struct", currType.Name.Name)
+			}
 
-			fmt.Printf("process struct %s\n", currType.Name.Name)
-			fmt.Printf("\tgenerating Unpack method\n")
+			structNames = append(structNames, currType.Name.Name)
+			binpackStructs[currType.Name.Name] = currStruct
+			structOptions[currType.Name.Name] = opts
+		}
+	}
 
-			fmt.Fprintln(out, "func (in *"+currType.Name.Name+") Unpack(data []byte) error {")
-			fmt.Fprintln(out, "	r := bytes.NewReader(data)")
+	body := &bytes.Buffer{}
+	if len(structNames) > 0 {
+		body.WriteString(runtimeCode)
+	}
+	for _, name := range structNames {
+		genStruct(body, name)
+	}
 
-		FIELDS_LOOP:
-			for _, field := range currStruct.Fields.List {
+	fmt.Fprintln(out, `package `+node.Name.Name)
+	fmt.Fprintln(out) // empty line
+	packages := make([]string, 0, len(imports))
+	for pkg := range imports {
+		packages = append(packages, pkg)
+	}
+	sort.Strings(packages)
+	for _, pkg := range packages {
+		fmt.Fprintln(out, `import "`+pkg+`"`)
+	}
+	if decl != "" {
+		fmt.Fprintln(out) // empty line
+		out.WriteString(decl)
+	}
+	body.WriteTo(out)
 
-				if field.Tag != nil {
-					tag := reflect.StructTag(field.Tag.Value[1 : len(field.Tag.Value)-1])
-					if tag.Get("cgen") == "-" {
-						continue FIELDS_LOOP
-					}
+	if *schemaFlag != "" {
+		writeSchemas(*schemaFlag, structNames)
+	}
+}
+
+// parseOptions applies the options of list, like be or len=u8, to opts
+func parseOptions(opts options, list []string) options {
+	for _, opt := range list {
+		switch {
+		case opt == "le":
+			opts.Order = "LittleEndian"
+		case opt == "be":
+			opts.Order = "BigEndian"
+		case opt == "varint":
+			opts.Varint = true
+		case opt == "fixed":
+			opts.Varint = false
+		case strings.HasPrefix(opt, "len="):
+			opts.Len = strings.TrimPrefix(opt, "len=")
+			if _, ok := lenPrefixes[opts.Len]; !ok && opts.Len != "varint" {
+				log.Fatalln("unsupported length prefix", opt)
+			}
+		case strings.HasPrefix(opt, "id="):
+			id, err := strconv.Atoi(strings.TrimPrefix(opt, "id="))
+			if err != nil || id <= 0 {
+				log.Fatalln("bad field number", opt)
+			}
+			opts.ID = id
+		case strings.HasPrefix(opt, "default="):
+			opts.Default = strings.TrimPrefix(opt, "default=")
+		case strings.HasPrefix(opt, "reserved="):
+			opts.Reserved = nil
+			for _, number := range strings.Split(strings.TrimPrefix(opt, "reserved="), ",") {
+				id, err := strconv.Atoi(number)
+				if err != nil || id <= 0 {
+					log.Fatalln("bad field number", opt)
 				}
+				opts.Reserved = append(opts.Reserved, id)
+			}
+		case strings.HasPrefix(opt, "size="):
+			size, err := strconv.Atoi(strings.TrimPrefix(opt, "size="))
+			if err != nil || size <= 0 {
+				log.Fatalln("bad size", opt)
+			}
+			opts.Size = size
+		default:
+			log.Fatalln("unknown option", opt)
+		}
+	}
+	return opts
+}
+
+// templateOption is the template="..." option of the cgen: binpack directive
+var templateOption = regexp.MustCompile(`template="([^"]*)"`)
 
-				fieldName := field.Names[0].Name
-				fileType := field.Type.(*ast.Ident).Name
+// packItem is a value of a Perl or Python pack template, like L, a8 or L/a*
+type packItem struct {
+	Letter byte
+	// Count is the number of numbers or the size of a string, -1 for *
+	Count int
+	// Prefix is the letter of the length before a string, like L of L/a*
+	Prefix byte
+}
 
-				fmt.Printf("\tgenerating code for field %s.%s\n", currType.Name.Name, fieldName)
+type packLetter struct {
+	// Types are the Go types of the letter, the first one is used
+	// by the struct generated from a template
+	Types []string
+	Order string
+	// Len is the length prefix of the letter before /
+	Len string
+}
 
-				switch fileType {
-				case "int":
-					intTpl.Execute(out, tpl{fieldName})
-				case "string":
-					strTpl.Execute(out, tpl{fieldName})
-				default:
-					log.Fatalln("unsupported", fileType)
+// packLetters are the numbers of pack templates,
+// S, L and Q are in the native byte order, which is taken as little endian
+var packLetters = map[byte]packLetter{
+	'C': {[]string{"uint8", "byte"}, "LittleEndian", "u8"},
+	'S': {[]string{"uint16"}, "LittleEndian", "u16"},
+	'L': {[]string{"uint32", "int", "uint"}, "LittleEndian", "u32"},
+	'Q': {[]string{"uint64"}, "LittleEndian", ""},
+	'n': {[]string{"uint16"}, "BigEndian", "u16"},
+	'N': {[]string{"uint32", "int", "uint"}, "BigEndian", "u32"},
+	'v': {[]string{"uint16"}, "LittleEndian", "u16"},
+	'V': {[]string{"uint32", "int", "uint"}, "LittleEndian", "u32"},
+}
+
+// parseTemplate splits a pack template, like "L L/a* L" or "nnZ8", into values
+func parseTemplate(template string) []packItem {
+	items := []packItem{}
+	for pos := 0; pos < len(template); {
+		if strings.IndexByte(" \t\n", template[pos]) >= 0 {
+			pos++
+			continue
+		}
+
+		item := packItem{Letter: template[pos]}
+		pos++
+		if pos < len(template) && template[pos] == '/' {
+			if _, ok := packLetters[item.Letter]; !ok || pos+1 == len(template) {
+				log.Fatalf("bad length prefix %q in template %q", item.Letter, template)
+			}
+			item.Prefix, item.Letter = item.Letter, template[pos+1]
+			pos += 2
+		}
+		if _, ok := packLetters[item.Letter]; !ok && strings.IndexByte("aAZ", item.Letter) < 0 {
+			log.Fatalf("unsupported letter %q in template %q", item.Letter, template)
+		}
+
+		end := pos
+		for end < len(template) && template[end] >= '0' && template[end] <= '9' {
+			end++
+		}
+		switch {
+		case end > pos:
+			item.Count, _ = strconv.Atoi(template[pos:end])
+			pos = end
+		case pos < len(template) && template[pos] == '*':
+			item.Count = -1
+			pos++
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// templateOptions are the options of the field f matching the value of the template,
+// its type has to fit the value
+func templateOptions(name string, f field, item packItem) options {
+	opts := defaultOptions
+	typ := types.ExprString(f.Type)
+	fieldName := name + "." + f.Name
+
+	if strings.IndexByte("aAZ", item.Letter) >= 0 {
+		if typ != "string" && (item.Letter != 'a' || !isBytes(f.Type)) {
+			log.Fatalln(fieldName, "is", typ, "but the template has a string", string(item.Letter))
+		}
+		switch {
+		case item.Prefix != 0 && item.Letter == 'a' && item.Count == -1:
+			prefix := packLetters[item.Prefix]
+			if prefix.Len == "" {
+				log.Fatalln("length prefix", string(item.Prefix), "of", fieldName, "is not supported")
+			}
+			opts.Order, opts.Len = prefix.Order, prefix.Len
+		case item.Prefix != 0 || item.Count == -1:
+			log.Fatalln("only strings of fixed size and X/a* are supported, not those of", fieldName)
+		default:
+			// a without count is a single byte
+			opts.Size, opts.Pad = item.Count, string(item.Letter)
+			if opts.Size == 0 {
+				opts.Size = 1
+			}
+		}
+		return opts
+	}
+
+	letter := packLetters[item.Letter]
+	opts.Order = letter.Order
+	if item.Count == -1 {
+		log.Fatalln("numbers up to the end of data are not supported, use a count for", fieldName)
+	}
+	if item.Count > 1 {
+		// L3 is an array of three numbers
+		array, ok := f.Type.(*ast.ArrayType)
+		if !ok || nil == array.Len || types.ExprString(array.Len) != strconv.Itoa(item.Count) {
+			log.Fatalln(fieldName, "is", typ, "but the template has", item.Count, "numbers", string(item.Letter))
+		}
+		typ = types.ExprString(array.Elt)
+	}
+	for _, allowed := range letter.Types {
+		if typ == allowed {
+			return opts
+		}
+	}
+	log.Fatalln(fieldName, "is", typ, "but the template has", string(item.Letter), "of", strings.Join(letter.Types, ", "))
+	return opts
+}
+
+// runtimeNames are the names declared by runtimeCode and the packages it imports,
+// the struct of -template can take none of them
+func runtimeNames() map[string]bool {
+	node, err := parser.ParseFile(token.NewFileSet(), "runtime", "package runtime\n"+runtimeCode, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	names := map[string]bool{"math": true}
+	for pkg := range imports {
+		names[path.Base(pkg)] = true
+	}
+	for _, decl := range node.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil {
+				names[d.Name.Name] = true
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					names[s.Name.Name] = true
+				case *ast.ValueSpec:
+					for _, name := range s.Names {
+						names[name.Name] = true
+					}
 				}
 			}
+		}
+	}
+	return names
+}
+
+// templateStruct is the declaration of the struct of the pack template,
+// fields are the comma separated names of its fields
+func templateStruct(name string, fields string, template string) string {
+	items := parseTemplate(template)
+	names := strings.Split(fields, ",")
+	if fields == "" {
+		names = make([]string, len(items))
+		for idx := range names {
+			names[idx] = fmt.Sprintf("F%d", idx+1)
+		}
+	}
+	if len(names) != len(items) {
+		log.Fatalln("template has", len(items), "values, but", len(names), "fields are given")
+	}
+
+	decl := &bytes.Buffer{}
+	fmt.Fprintf(decl, "// %s is generated from the pack template %q\n", name, template)
+	fmt.Fprintf(decl, "// cgen: binpack template=%q\n", template)
+	fmt.Fprintln(decl, "type "+name+" struct {")
+	for idx, item := range items {
+		typ := "string"
+		if letter, ok := packLetters[item.Letter]; ok {
+			typ = letter.Types[0]
+			if item.Count > 1 {
+				typ = "[" + strconv.Itoa(item.Count) + "]" + typ
+			}
+		}
+		fmt.Fprintln(decl, "	"+strings.TrimSpace(names[idx])+" "+typ)
+	}
+	fmt.Fprintln(decl, "}")
+
+	// fields are aligned like in a hand written struct
+	code, err := format.Source(decl.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return string(code)
+}
+
+// structFields are the fields of the struct in the order of Pack and Unpack
+func structFields(name string) []field {
+	fields := []field{}
+	items, hasTemplate := structTemplates[name]
+FIELDS_LOOP:
+	for _, f := range binpackStructs[name].Fields.List {
+		if len(f.Names) == 0 {
+			log.Fatalln("embedded field", types.ExprString(f.Type), "of struct", name, "is not supported, give it a name")
+		}
+
+		opts := structOptions[name]
+		if f.Tag != nil {
+			tag := reflect.StructTag(f.Tag.Value[1 : len(f.Tag.Value)-1])
+			if tag.Get("cgen") == "-" {
+				continue FIELDS_LOOP
+			}
+			if hasTemplate && tag.Get("cgen") != "" {
+				log.Fatalln("template defines the whole layout of struct", name, "only cgen:\"-\" is allowed")
+			}
+			if tag.Get("cgen") != "" {
+				// cgen:"be,len=u8"
+				opts = parseOptions(opts, strings.Split(tag.Get("cgen"), ","))
+			}
+			if strings.Contains(tag.Get("cgen"), "reserved=") {
+				log.Fatalln("reserved is an option of struct, not of field", name)
+			}
+		}
+
+		for _, fieldName := range f.Names {
+			fields = append(fields, field{fieldName.Name, f.Type, opts})
+		}
+	}
+
+	if hasTemplate {
+		if len(items) != len(fields) {
+			log.Fatalln("template of", name, "has", len(items), "values, struct has", len(fields), "fields")
+		}
+		for idx := range fields {
+			fields[idx].Opts = templateOptions(name, fields[idx], items[idx])
+		}
+	}
+	return fields
+}
+
+func genStruct(out *bytes.Buffer, name string) {
+	fmt.Printf("process struct %s\n", name)
 
-			fmt.Fprintln(out, "	return nil")
-			fmt.Fprintln(out, "}") // end of Unpack func
-			fmt.Fprintln(out)      // empty line
+	fields := structFields(name)
 
+	fmt.Printf("\tgenerating Unpack method\n")
+
+	fmt.Fprintln(out) // empty line
+	fmt.Fprintln(out, "func (in *"+name+") Unpack(data []byte) error {")
+	fmt.Fprintln(out, "	_, err := in.unpackFrom(data, 0, false)")
+	fmt.Fprintln(out, "	return err")
+	fmt.Fprintln(out, "}")
+	fmt.Fprintln(out) // empty line
+	fmt.Fprintln(out, "// UnpackNoCopy is Unpack with strings and []byte sharing memory with data,")
+	fmt.Fprintln(out, "// data must not change while they are in use")
+	fmt.Fprintln(out, "func (in *"+name+") UnpackNoCopy(data []byte) error {")
+	fmt.Fprintln(out, "	_, err := in.unpackFrom(data, 0, true)")
+	fmt.Fprintln(out, "	return err")
+	fmt.Fprintln(out, "}")
+	fmt.Fprintln(out) // empty line
+	fmt.Fprintln(out, "// UnpackStrict is Unpack failing with ErrTrailingBytes when data is longer than the struct")
+	fmt.Fprintln(out, "func (in *"+name+") UnpackStrict(data []byte) error {")
+	fmt.Fprintln(out, "	off, err := in.unpackFrom(data, 0, false)")
+	fmt.Fprintln(out, "	if nil != err {")
+	fmt.Fprintln(out, "		return err")
+	fmt.Fprintln(out, "	}")
+	fmt.Fprintln(out, "	if off < len(data) {")
+	fmt.Fprintln(out, "		return &UnpackError{Offset: int64(off), Err: ErrTrailingBytes}")
+	fmt.Fprintln(out, "	}")
+	fmt.Fprintln(out, "	return nil")
+	fmt.Fprintln(out, "}")
+	fmt.Fprintln(out) // empty line
+	fmt.Fprintln(out, "// unpackFrom reads the struct at data[off:] and returns the offset after it")
+	fmt.Fprintln(out, "func (in *"+name+") unpackFrom(data []byte, off int, alias bool) (int, error) {")
+
+	if isTagged(name) {
+		genTaggedUnpack(out, name, fields)
+	} else {
+		for idx, f := range fields {
+			fmt.Printf("\tgenerating code for field %s.%s\n", name, f.Name)
+			if idx > 0 {
+				fmt.Fprintln(out) // empty line
+			}
+			fmt.Fprintln(out, "	// "+f.Name)
+			out.WriteString(unpackCode("in."+f.Name, f.Name, f.Name, nil, f.Type, f.Opts))
 		}
+		fmt.Fprintln(out, "	return off, nil")
 	}
+
+	fmt.Fprintln(out, "}") // end of unpackFrom func
+
+	fmt.Printf("\tgenerating Pack method\n")
+
+	fmt.Fprintln(out) // empty line
+	fmt.Fprintln(out, "func (in *"+name+") Pack() ([]byte, error) {")
+	fmt.Fprintln(out, "	w := &bytes.Buffer{}")
+	fmt.Fprintln(out, "	if err := in.packTo(w); nil != err {")
+	fmt.Fprintln(out, "		return nil, err")
+	fmt.Fprintln(out, "	}")
+	fmt.Fprintln(out, "	return w.Bytes(), nil")
+	fmt.Fprintln(out, "}")
+	fmt.Fprintln(out) // empty line
+	fmt.Fprintln(out, "func (in *"+name+") packTo(w *bytes.Buffer) error {")
+
+	tagged := isTagged(name)
+	for idx, f := range fields {
+		if idx > 0 {
+			fmt.Fprintln(out) // empty line
+		}
+		fmt.Fprintln(out, "	// "+f.Name)
+		if !tagged {
+			out.WriteString(packCode("in."+f.Name, f.Name, f.Type, f.Opts, 0))
+			continue
+		}
+		fmt.Fprintf(out, "	writeUvarint(w, %d)\n", f.Opts.ID)
+		fmt.Fprintln(out, "	"+f.Name+"Start := w.Len()")
+		out.WriteString(packCode("in."+f.Name, f.Name, f.Type, f.Opts, 0))
+		fmt.Fprintln(out, "	endField(w, "+f.Name+"Start)")
+	}
+
+	if tagged {
+		fmt.Fprintln(out) // empty line
+		fmt.Fprintln(out, "	w.WriteByte(0)")
+	}
+	fmt.Fprintln(out, "	return nil")
+	fmt.Fprintln(out, "}") // end of packTo func
+
+	fmt.Printf("\tgenerating EncodeTo and DecodeFrom methods\n")
+
+	fmt.Fprintln(out) // empty line
+	fmt.Fprintln(out, "// EncodeTo writes the struct to w as a frame, its length as uvarint and the bytes of Pack")
+	fmt.Fprintln(out, "func (in *"+name+") EncodeTo(w io.Writer) error {")
+	fmt.Fprintln(out, "	return writeFrame(w, in, &bytes.Buffer{})")
+	fmt.Fprintln(out, "}")
+	fmt.Fprintln(out) // empty line
+	fmt.Fprintln(out, "// DecodeFrom reads the frame written by EncodeTo and nothing after it,")
+	fmt.Fprintln(out, "// the length is read byte by byte unless r is an io.ByteReader like *bufio.Reader")
+	fmt.Fprintln(out, "func (in *"+name+") DecodeFrom(r io.Reader) error {")
+	fmt.Fprintln(out, "	src, ok := r.(frameSource)")
+	fmt.Fprintln(out, "	if !ok {")
+	fmt.Fprintln(out, "		src = byteReader{r}")
+	fmt.Fprintln(out, "	}")
+	fmt.Fprintln(out, "	_, err := readFrame(src, in, nil)")
+	fmt.Fprintln(out, "	return err")
+	fmt.Fprintln(out, "}")
+}
+
+// isTagged tells if the fields of the struct are numbered with cgen:"id=N"
+func isTagged(name string) bool {
+	for _, f := range structFields(name) {
+		if f.Opts.ID > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// genTaggedUnpack is the body of unpackFrom of a tagged struct,
+// every field is its number, the length and the value, number 0 ends the struct
+func genTaggedUnpack(out *bytes.Buffer, name string, fields []field) {
+	reserved := map[int]string{}
+	for _, id := range structOptions[name].Reserved {
+		reserved[id] = "a removed field"
+	}
+	// the fields not in data are reset, the skipped ones are kept
+	values := keptFields(name)
+	for _, f := range fields {
+		if f.Opts.ID == 0 {
+			log.Fatalln("field", f.Name, "of tagged struct", name, "has no id")
+		}
+		if used, ok := reserved[f.Opts.ID]; ok {
+			log.Fatalln("field", f.Name, "of", name, "reuses number", f.Opts.ID, "of", used)
+		}
+		reserved[f.Opts.ID] = f.Name
+		if f.Opts.Default != "" {
+			values = append(values, f.Name+": "+defaultValue(name, f))
+		}
+	}
+
+	fmt.Fprintln(out, "	*in = "+name+"{"+strings.Join(values, ", ")+"}")
+	fmt.Fprintln(out, "	for {")
+	fmt.Fprintln(out, "		id, start, end, err := fieldHeader(data, off)")
+	fmt.Fprintln(out, "		if nil != err {")
+	fmt.Fprintln(out, "			return off, err")
+	fmt.Fprintln(out, "		}")
+	fmt.Fprintln(out, "		if id == 0 {")
+	fmt.Fprintln(out, "			return end, nil")
+	fmt.Fprintln(out, "		}")
+	fmt.Fprintln(out, "		off = start")
+	fmt.Fprintln(out, "		switch id {")
+	for _, f := range fields {
+		fmt.Printf("\tgenerating code for field %s.%s\n", name, f.Name)
+		fmt.Fprintf(out, "		case %d: // %s\n", f.Opts.ID, f.Name)
+		// the value can not be read past the end of the field
+		fmt.Fprintln(out, "			data := data[:end]")
+		out.WriteString(indent(indent(unpackCode("in."+f.Name, f.Name, f.Name, nil, f.Type, f.Opts))))
+	}
+	fmt.Fprintln(out, "		}")
+	// unknown fields of a newer version are skipped
+	fmt.Fprintln(out, "		off = end")
+	fmt.Fprintln(out, "	}")
+}
+
+// keptFields are the fields skipped with cgen:"-", set to the value they had
+func keptFields(name string) []string {
+	kept := []string{}
+	for _, f := range binpackStructs[name].Fields.List {
+		if f.Tag == nil || reflect.StructTag(f.Tag.Value[1:len(f.Tag.Value)-1]).Get("cgen") != "-" {
+			continue
+		}
+		for _, fieldName := range f.Names {
+			kept = append(kept, fieldName.Name+": in."+fieldName.Name)
+		}
+	}
+	return kept
+}
+
+// defaultValue is the Go literal of the default of f
+func defaultValue(name string, f field) string {
+	typ := types.ExprString(f.Type)
+	var err error
+	switch {
+	case typ == "string":
+		return strconv.Quote(f.Opts.Default)
+	case typ == "bool":
+		_, err = strconv.ParseBool(f.Opts.Default)
+	case typ == "float32" || typ == "float64":
+		_, err = strconv.ParseFloat(f.Opts.Default, fixedTypes[typ]*8)
+	case typ == "int" || strings.HasPrefix(typ, "int") && fixedTypes[typ] > 0:
+		// int has the bit size 0 of strconv, that is the size of int
+		_, err = strconv.ParseInt(f.Opts.Default, 10, fixedTypes[typ]*8)
+	case typ == "uint" || fixedTypes[typ] > 0:
+		_, err = strconv.ParseUint(f.Opts.Default, 10, fixedTypes[typ]*8)
+	default:
+		log.Fatalln("default applies to numbers, bool and strings, not to", typ, "of", name+"."+f.Name)
+	}
+	if err != nil {
+		log.Fatalln("bad default", f.Opts.Default, "of", name+"."+f.Name)
+	}
+	return f.Opts.Default
+}
+
+// newTpl is the data of the templates of expr of type typ
+func newTpl(expr string, name string, typ ast.Expr, opts options, depth int) tpl {
+	data := tpl{
+		Expr:  expr,
+		Var:   name,
+		Type:  types.ExprString(typ),
+		Order: opts.Order,
+		Size:  strconv.Itoa(opts.Size),
+		Pad:   opts.Pad,
+		Index: fmt.Sprintf("i%d", depth),
+	}
+	if opts.Len == "varint" {
+		data.LenVarint = true
+	} else {
+		prefix := lenPrefixes[opts.Len]
+		data.LenType, data.LenSize, data.LenMax = prefix.Type, prefix.Size, prefix.Max
+		data.LenRead = readExpr(prefix.Type, opts.Order)
+	}
+	return data
+}
+
+// isVarint tells if the value of typ is a varint under opts
+func isVarint(typ ast.Expr, opts options) bool {
+	t, ok := typ.(*ast.Ident)
+	if !ok || !opts.Varint {
+		return false
+	}
+	_, ok = varintTypes[t.Name]
+	return ok
+}
+
+// isFixed tells if elements of typ are read and written by one binary call
+func isFixed(typ ast.Expr, opts options) bool {
+	t, ok := typ.(*ast.Ident)
+	return ok && fixedTypes[t.Name] > 0 && !isVarint(typ, opts)
+}
+
+// isBytes tells []byte and []uint8 apart from other slices
+func isBytes(typ ast.Expr) bool {
+	t, ok := typ.(*ast.ArrayType)
+	if !ok || nil != t.Len {
+		return false
+	}
+	elem, ok := t.Elt.(*ast.Ident)
+	return ok && (elem.Name == "byte" || elem.Name == "uint8")
+}
+
+// unpackCode is the code reading expr of type typ from data at off,
+// path with the indexes of the enclosing slices and arrays names it in errors
+func unpackCode(expr string, name string, path string, indexes []string, typ ast.Expr, opts options) string {
+	data := newTpl(expr, name, typ, opts, len(indexes))
+	data.Field = strconv.Quote(path)
+	if len(indexes) > 0 {
+		data.Field = "fmt.Sprintf(" + strconv.Quote(path) + ", " + strings.Join(indexes, ", ") + ")"
+	}
+
+	if opts.Size > 0 {
+		switch {
+		case data.Type == "string":
+			return execute(paddedStrTpl, data)
+		case isBytes(typ):
+			return execute(paddedBytesTpl, data)
+		}
+		if _, ok := typ.(*ast.ArrayType); !ok {
+			log.Fatalln("size applies to strings and []byte, not to", data.Type, "of", name)
+		}
+	}
+
+	switch t := typ.(type) {
+	case *ast.Ident:
+		switch {
+		case isVarint(typ, opts):
+			bounds := varintTypes[t.Name]
+			data.Signed = bounds.Signed
+			switch {
+			case bounds.Min != "":
+				data.Range = name + "Raw < " + bounds.Min + " || " + name + "Raw > " + bounds.Max
+			case bounds.Max != "":
+				data.Range = name + "Raw > " + bounds.Max
+			}
+			imports["math"] = imports["math"] || data.Range != ""
+			return execute(varintTpl, data)
+		case t.Name == "int" || t.Name == "uint":
+			return execute(intTpl, data)
+		case fixedTypes[t.Name] > 0:
+			data.Size = strconv.Itoa(fixedTypes[t.Name])
+			data.Read = readExpr(t.Name, opts.Order)
+			return execute(fixedTpl, data)
+		case t.Name == "string":
+			data.Min = 1
+			return execute(strTpl, data)
+		case nil != binpackStructs[t.Name]:
+			return execute(structTpl, data)
+		}
+	case *ast.ArrayType:
+		size := 0
+		if isFixed(t.Elt, opts) {
+			elem := t.Elt.(*ast.Ident).Name
+			size = fixedTypes[elem]
+			data.Min = size
+			data.Read = readExpr(elem, opts.Order)
+			data.Bytes = elem == "byte" || elem == "uint8"
+		}
+		switch {
+		case nil == t.Len && data.Bytes:
+			return execute(bytesTpl, data)
+		case nil == t.Len && size > 0:
+			return execute(fixedSliceTpl, data)
+		case nil != t.Len && size > 0:
+			data.Size = "len(" + expr + ")"
+			if size > 1 {
+				data.Size += "*" + strconv.Itoa(size)
+			}
+			return execute(fixedArrayTpl, data)
+		}
+		elemIndexes := append(append([]string{}, indexes...), data.Index)
+		data.Elem = indent(unpackCode(expr+"["+data.Index+"]", name+"Elem", path+"[%d]", elemIndexes, t.Elt, opts))
+		if nil == t.Len {
+			data.Min = minSize(t.Elt, opts)
+			return execute(sliceTpl, data)
+		}
+		return execute(arrayTpl, data)
+	}
+	log.Fatalln("unsupported", data.Type, "of", name)
+	return ""
+}
+
+// minSize is the least number of bytes of a value of typ in data,
+// zero when it is not known
+func minSize(typ ast.Expr, opts options) int {
+	lenSize := lenPrefixes[opts.Len].Size
+	if opts.Len == "varint" {
+		lenSize = 1
+	}
+	if opts.Size > 0 && (types.ExprString(typ) == "string" || isBytes(typ)) {
+		return opts.Size
+	}
+
+	switch t := typ.(type) {
+	case *ast.Ident:
+		switch {
+		case isVarint(typ, opts):
+			return 1
+		case t.Name == "int" || t.Name == "uint":
+			return 4
+		case t.Name == "string":
+			return lenSize
+		case fixedTypes[t.Name] > 0:
+			return fixedTypes[t.Name]
+		case nil != binpackStructs[t.Name] && isTagged(t.Name):
+			return 1
+		case nil != binpackStructs[t.Name]:
+			size := 0
+			for _, f := range structFields(t.Name) {
+				size += minSize(f.Type, f.Opts)
+			}
+			return size
+		}
+	case *ast.ArrayType:
+		if nil == t.Len {
+			return lenSize
+		}
+		if lit, ok := t.Len.(*ast.BasicLit); ok {
+			n, _ := strconv.Atoi(lit.Value)
+			return n * minSize(t.Elt, opts)
+		}
+	}
+	return 0
+}
+
+// packCode is the code writing expr of type typ to w
+func packCode(expr string, name string, typ ast.Expr, opts options, depth int) string {
+	data := newTpl(expr, name, typ, opts, depth)
+
+	if opts.Size > 0 && (data.Type == "string" || isBytes(typ)) {
+		return execute(packPaddedTpl, data)
+	}
+
+	switch t := typ.(type) {
+	case *ast.Ident:
+		switch {
+		case isVarint(typ, opts):
+			data.Signed = varintTypes[t.Name].Signed
+			return execute(packVarintTpl, data)
+		case t.Name == "int" || t.Name == "uint":
+			imports["math"] = true
+			return execute(packIntTpl, data)
+		case fixedTypes[t.Name] > 0:
+			return execute(packFixedTpl, data)
+		case t.Name == "string":
+			imports["math"] = imports["math"] || !data.LenVarint
+			return execute(packStrTpl, data)
+		case nil != binpackStructs[t.Name]:
+			return execute(packStructTpl, data)
+		}
+	case *ast.ArrayType:
+		switch {
+		case nil == t.Len && isFixed(t.Elt, opts):
+			imports["math"] = imports["math"] || !data.LenVarint
+			return execute(packFixedSliceTpl, data)
+		case nil != t.Len && isFixed(t.Elt, opts):
+			return execute(packFixedTpl, data)
+		}
+		data.Elem = indent(packCode(expr+"["+data.Index+"]", name+"Elem", t.Elt, opts, depth+1))
+		if nil == t.Len {
+			imports["math"] = imports["math"] || !data.LenVarint
+			return execute(packSliceTpl, data)
+		}
+		return execute(arrayTpl, data)
+	}
+	log.Fatalln("unsupported", data.Type, "of", name)
+	return ""
+}
+
+func execute(t *template.Template, data tpl) string {
+	code := &bytes.Buffer{}
+	if err := t.Execute(code, data); err != nil {
+		log.Fatal(err)
+	}
+	return code.String()
+}
+
+// indent shifts the code of an element into the loop body
+func indent(code string) string {
+	return "\t" + strings.Replace(strings.TrimSuffix(code, "\n"), "\n", "\n\t", -1) + "\n"
 }
 
 // go build gen/* && ./codegen.exe pack/unpack.go  pack/marshaller.go
-// go run pack/*
+// go run ./pack
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the generator itself when the test binary is started by runGen
+func TestMain(m *testing.M) {
+	if os.Getenv("BINPACK_CODEGEN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runGen runs the generator with args and returns its output
+func runGen(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "BINPACK_CODEGEN=1")
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestEmbeddedField(t *testing.T) {
+	// встроенная структура не должна молча пропадать из данных
+	src := `package main
+
+// cgen: binpack
+type B struct {
+	Y int
+}
+
+// cgen: binpack
+type A struct {
+	B
+	X int
+}
+`
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.go")
+	if err := ioutil.WriteFile(input, []byte(src), 0644); nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out, err := runGen(t, input, filepath.Join(dir, "output.go"))
+	expected := "embedded field B of struct A is not supported"
+	if nil == err || !strings.Contains(out, expected) {
+		t.Errorf("expected %q, got %v\n%s", expected, err, out)
+	}
+}
+
+func TestDefaultValue(t *testing.T) {
+	cases := []struct {
+		Field    string
+		Expected string
+	}{
+		{
+			Field: "Port uint16 `cgen:\"id=1,default=8080\"`",
+		},
+		{
+			Field: "Rating float32 `cgen:\"id=1,default=1.5\"`",
+		},
+		{
+			Field: "Delta int `cgen:\"id=1,default=-3\"`",
+		},
+		{ // дробное число не становится целым
+			Field:    "Port uint16 `cgen:\"id=1,default=1.5\"`",
+			Expected: "bad default 1.5 of Config.Port",
+		},
+		{
+			Field:    "Delta int `cgen:\"id=1,default=2.0\"`",
+			Expected: "bad default 2.0 of Config.Delta",
+		},
+		{ // значение должно помещаться в тип поля
+			Field:    "Level int8 `cgen:\"id=1,default=300\"`",
+			Expected: "bad default 300 of Config.Level",
+		},
+		{
+			Field:    "Kind uint8 `cgen:\"id=1,default=-1\"`",
+			Expected: "bad default -1 of Config.Kind",
+		},
+		{
+			Field:    "Rating float32 `cgen:\"id=1,default=1e40\"`",
+			Expected: "bad default 1e40 of Config.Rating",
+		},
+	}
+
+	dir := t.TempDir()
+	for idx, item := range cases {
+		input := filepath.Join(dir, "input.go")
+		src := "package main\n\n// cgen: binpack\ntype Config struct {\n\t" + item.Field + "\n}\n"
+		if err := ioutil.WriteFile(input, []byte(src), 0644); nil != err {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		out, err := runGen(t, input, filepath.Join(dir, "output.go"))
+		if item.Expected == "" && nil != err {
+			t.Errorf("[%d] unexpected error: %v\n%s", idx, err, out)
+		}
+		if item.Expected != "" && (nil == err || !strings.Contains(out, item.Expected)) {
+			t.Errorf("[%d] expected %q, got %v\n%s", idx, item.Expected, err, out)
+		}
+	}
+}
+
+func TestTemplateDefaultType(t *testing.T) {
+	gobin, err := exec.LookPath("go")
+	if nil != err {
+		t.Skip("go is not installed")
+	}
+
+	// структура по умолчанию не должна конфликтовать с кодом рантайма
+	dir := t.TempDir()
+	output := filepath.Join(dir, "packed.go")
+	if out, err := runGen(t, "-template", "L L/a* L", "-package", "packed", output); nil != err {
+		t.Fatalf("unexpected error: %v\n%s", err, out)
+	}
+	if out, err := exec.Command(gobin, "vet", output).CombinedOutput(); nil != err {
+		t.Errorf("generated code does not compile: %v\n%s", err, out)
+	}
+}
+
+func TestTemplateTypeTaken(t *testing.T) {
+	cases := []string{"Record", "FrameWriter", "ErrTruncated", "writeUvarint", "bytes"}
+
+	dir := t.TempDir()
+	for idx, name := range cases {
+		out, err := runGen(t, "-template", "L L/a* L", "-type", name, filepath.Join(dir, "output.go"))
+		expected := "-type " + name + " is taken by the runtime code"
+		if nil == err || !strings.Contains(out, expected) {
+			t.Errorf("[%d] expected %q, got %v\n%s", idx, expected, err, out)
+		}
+	}
+}
+
+func TestSchemaGolden(t *testing.T) {
+	// pack/schema сгенерирован из pack/unpack.go и должен совпадать с новым выводом,
+	// каталог создаётся генератором
+	dir := filepath.Join(t.TempDir(), "schema")
+	out, err := runGen(t, "-schema", dir, filepath.Join("..", "pack", "unpack.go"), filepath.Join(t.TempDir(), "marshaller.go"))
+	if nil != err {
+		t.Fatalf("unexpected error: %v\n%s", err, out)
+	}
+
+	golden, err := filepath.Glob(filepath.Join("..", "pack", "schema", "*"))
+	if nil != err || len(golden) == 0 {
+		t.Fatalf("no golden files: %v", err)
+	}
+	generated, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(generated) != len(golden) {
+		t.Errorf("expected %d files, got %d", len(golden), len(generated))
+	}
+	for _, name := range golden {
+		expected, _ := ioutil.ReadFile(name)
+		got, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(name)))
+		if nil != err {
+			t.Errorf("%s: %v", filepath.Base(name), err)
+			continue
+		}
+		if string(got) != string(expected) {
+			t.Errorf("%s differs from the generated one, regenerate pack/schema", filepath.Base(name))
+		}
+	}
+}
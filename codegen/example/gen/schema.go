@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// schemaType is the wire layout of a value in the schema for other languages
+type schemaType struct {
+	// Kind is uint, int, float, bool, string, bytes, array or struct
+	Kind string `json:"kind"`
+	// Size is the number of bytes of a number, a string or bytes of fixed size
+	Size int `json:"size,omitempty"`
+	// Order is le or be, single bytes have none
+	Order string `json:"order,omitempty"`
+	// Encoding is varint for unsigned varints and zigzag for signed ones
+	Encoding string `json:"encoding,omitempty"`
+	// Padding of a string of fixed size is zero when it ends at the first zero byte,
+	// space when the trailing spaces and zeros are trimmed and raw when it is kept as is
+	Padding string `json:"padding,omitempty"`
+	// Length is the prefix of a string, bytes or an array
+	Length *schemaType `json:"length,omitempty"`
+	// Count is the number of the elements of an array without prefix
+	Count  int         `json:"count,omitempty"`
+	Elem   *schemaType `json:"elem,omitempty"`
+	Struct string      `json:"struct,omitempty"`
+}
+
+type schemaField struct {
+	Name string `json:"name"`
+	// ID and Default are set in tagged structs
+	ID      int        `json:"id,omitempty"`
+	Default string     `json:"default,omitempty"`
+	Type    schemaType `json:"type"`
+}
+
+type schemaStruct struct {
+	Name string `json:"name"`
+	// Tagged structs write every field as its number and length as varints
+	// followed by the value and end with number 0
+	Tagged bool          `json:"tagged,omitempty"`
+	Fields []schemaField `json:"fields"`
+}
+
+// schemaFile describes the struct Root, Structs are it and the structs nested in it
+type schemaFile struct {
+	Format  string         `json:"format"`
+	Root    string         `json:"root"`
+	Structs []schemaStruct `json:"structs"`
+}
+
+// writeSchemas writes the JSON schema, the Python decoder and the Kaitai Struct
+// description of every struct to dir, the files are named after the struct
+func writeSchemas(dir string, names []string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	for _, name := range names {
+		fmt.Printf("\tgenerating schemas of struct %s\n", name)
+		schema := newSchema(name)
+		data, err := json.MarshalIndent(schema, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		base := filepath.Join(dir, snakeCase(name))
+		for ext, code := range map[string][]byte{
+			".json": append(data, '\n'),
+			".py":   pythonDecoder(schema),
+			".ksy":  kaitaiStruct(schema),
+		} {
+			if err := ioutil.WriteFile(base+ext, code, 0644); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+}
+
+// newSchema is the schema of the struct and of the structs nested in it
+func newSchema(name string) schemaFile {
+	schema := schemaFile{Format: "binpack", Root: name}
+	seen := map[string]bool{name: true}
+	for queue := []string{name}; len(queue) > 0; queue = queue[1:] {
+		current := schemaStruct{Name: queue[0], Tagged: isTagged(queue[0])}
+		for _, f := range structFields(queue[0]) {
+			sf := schemaField{Name: f.Name, Type: schemaOf(f.Type, f.Opts)}
+			if current.Tagged {
+				sf.ID, sf.Default = f.Opts.ID, f.Opts.Default
+			}
+			for _, nested := range nestedStructs(sf.Type) {
+				if !seen[nested] {
+					seen[nested] = true
+					queue = append(queue, nested)
+				}
+			}
+			current.Fields = append(current.Fields, sf)
+		}
+		schema.Structs = append(schema.Structs, current)
+	}
+	return schema
+}
+
+func nestedStructs(t schemaType) []string {
+	switch {
+	case t.Kind == "struct":
+		return []string{t.Struct}
+	case nil != t.Elem:
+		return nestedStructs(*t.Elem)
+	}
+	return nil
+}
+
+// schemaOf is the layout of typ under opts, the same as the one of packCode
+func schemaOf(typ ast.Expr, opts options) schemaType {
+	order := "le"
+	if opts.Order == "BigEndian" {
+		order = "be"
+	}
+
+	if opts.Size > 0 && (isBytes(typ) || types.ExprString(typ) == "string") {
+		t := schemaType{Kind: "string", Size: opts.Size, Padding: "zero"}
+		switch {
+		case isBytes(typ):
+			t.Kind, t.Padding = "bytes", "raw"
+		case opts.Pad == "a":
+			t.Padding = "raw"
+		case opts.Pad == "A":
+			t.Padding = "space"
+		}
+		return t
+	}
+
+	length := &schemaType{Kind: "uint", Encoding: "varint"}
+	if opts.Len != "varint" {
+		length = &schemaType{Kind: "uint", Size: lenPrefixes[opts.Len].Size}
+		if length.Size > 1 {
+			length.Order = order
+		}
+	}
+
+	switch t := typ.(type) {
+	case *ast.Ident:
+		switch {
+		case isVarint(typ, opts) && varintTypes[t.Name].Signed:
+			return schemaType{Kind: "int", Encoding: "zigzag"}
+		case isVarint(typ, opts):
+			return schemaType{Kind: "uint", Encoding: "varint"}
+		case t.Name == "int" || t.Name == "uint":
+			return schemaType{Kind: "uint", Size: 4, Order: order}
+		case t.Name == "bool":
+			return schemaType{Kind: "bool", Size: 1}
+		case fixedTypes[t.Name] > 0:
+			number := schemaType{Kind: "uint", Size: fixedTypes[t.Name]}
+			switch {
+			case strings.HasPrefix(t.Name, "int"):
+				number.Kind = "int"
+			case strings.HasPrefix(t.Name, "float"):
+				number.Kind = "float"
+			}
+			if number.Size > 1 {
+				number.Order = order
+			}
+			return number
+		case t.Name == "string":
+			return schemaType{Kind: "string", Length: length}
+		case nil != binpackStructs[t.Name]:
+			return schemaType{Kind: "struct", Struct: t.Name}
+		}
+	case *ast.ArrayType:
+		if nil == t.Len && isBytes(typ) {
+			return schemaType{Kind: "bytes", Length: length}
+		}
+		elem := schemaOf(t.Elt, opts)
+		if nil == t.Len {
+			return schemaType{Kind: "array", Length: length, Elem: &elem}
+		}
+		count, _ := strconv.Atoi(types.ExprString(t.Len))
+		if elem.Kind == "uint" && elem.Size == 1 && elem.Encoding == "" {
+			return schemaType{Kind: "bytes", Size: count}
+		}
+		return schemaType{Kind: "array", Count: count, Elem: &elem}
+	}
+	log.Fatalln("unsupported", types.ExprString(typ), "in schema")
+	return schemaType{}
+}
+
+// snakeCase is the name in the style of Python and Kaitai Struct, ProfileV2 is profile_v2
+func snakeCase(name string) string {
+	runes := []rune(name)
+	out := &strings.Builder{}
+	for idx, r := range runes {
+		if idx > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[idx-1]) || idx+1 < len(runes) && unicode.IsLower(runes[idx+1])) {
+			out.WriteByte('_')
+		}
+		out.WriteRune(unicode.ToLower(r))
+	}
+	return out.String()
+}
+
+// pythonRuntime is the reader shared by the decoders of the structs
+const pythonRuntime = `class UnpackError(ValueError):
+    pass
+
+
+class Reader:
+    def __init__(self, data):
+        self.data = data
+        self.off = 0
+        self.end = len(data)
+
+    def read(self, size, field):
+        if size > self.end - self.off:
+            raise UnpackError("unpack %s at offset %d: truncated data" % (field, self.off))
+        value = self.data[self.off:self.off + size]
+        self.off += size
+        return value
+
+    def number(self, fmt, field):
+        return struct.unpack(fmt, self.read(struct.calcsize(fmt), field))[0]
+
+    def uvarint(self, field):
+        value, shift = 0, 0
+        while True:
+            b = self.read(1, field)[0]
+            value |= (b & 0x7F) << shift
+            if b < 0x80:
+                return value
+            shift += 7
+            if shift > 63:
+                raise UnpackError("unpack %s at offset %d: value overflows the field" % (field, self.off))
+
+    def varint(self, field):
+        value = self.uvarint(field)
+        return (value >> 1) ^ -(value & 1)
+
+    def string(self, size, field):
+        return self.read(size, field).decode("utf-8", "surrogateescape")
+
+    def padded(self, size, padding, field):
+        value = self.read(size, field)
+        if padding == "zero":
+            value = value.split(b"\0", 1)[0]
+        elif padding == "space":
+            value = value.rstrip(b"\0 \t\n\r")
+        return value.decode("utf-8", "surrogateescape")
+
+    def field(self):
+        """reads the number and the length of the field of a tagged struct,
+        returns the number and the end of the field, number 0 ends the struct"""
+        number = self.uvarint("")
+        if number == 0:
+            return 0, self.off
+        size = self.uvarint("")
+        if size > self.end - self.off:
+            raise UnpackError("unpack at offset %d: truncated data" % self.off)
+        return number, self.off + size
+`
+
+var pythonFormats = map[string]string{
+	"uint1": "B", "uint2": "H", "uint4": "I", "uint8": "Q",
+	"int1": "b", "int2": "h", "int4": "i", "int8": "q",
+	"float4": "f", "float8": "d", "bool1": "?",
+}
+
+// pythonDecoder is the Python module decoding the root struct of the schema
+func pythonDecoder(schema schemaFile) []byte {
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "# Code generated by codegen from the binpack struct %s. DO NOT EDIT.\n", schema.Root)
+	fmt.Fprintf(out, "\"\"\"Decoder of %s written by Pack of the Go struct.\n\n", schema.Root)
+	fmt.Fprintln(out, "unpack(data) returns the fields as a dict, the module run as a script")
+	fmt.Fprintln(out, "decodes stdin and prints JSON with bytes as lists of numbers.")
+	fmt.Fprintln(out, "\"\"\"")
+	fmt.Fprintln(out, "import json")
+	fmt.Fprintln(out, "import struct")
+	fmt.Fprintln(out, "import sys")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out)
+	out.WriteString(pythonRuntime)
+
+	for _, s := range schema.Structs {
+		fmt.Fprintln(out)
+		fmt.Fprintln(out)
+		fmt.Fprintf(out, "def read_%s(r):\n", snakeCase(s.Name))
+		if !s.Tagged {
+			fmt.Fprintln(out, "    v = {}")
+			for _, f := range s.Fields {
+				fmt.Fprintf(out, "    v[%q] = %s\n", f.Name, pythonExpr(f.Type, f.Name))
+			}
+			fmt.Fprintln(out, "    return v")
+			continue
+		}
+
+		// fields missing in data keep the zero value or the default,
+		// unknown ones are skipped
+		values := []string{}
+		for _, f := range s.Fields {
+			values = append(values, fmt.Sprintf("%q: %s", f.Name, pythonDefault(f, schema)))
+		}
+		fmt.Fprintf(out, "    v = {%s}\n", strings.Join(values, ", "))
+		fmt.Fprintln(out, "    while True:")
+		fmt.Fprintln(out, "        number, end = r.field()")
+		fmt.Fprintln(out, "        if number == 0:")
+		fmt.Fprintln(out, "            return v")
+		fmt.Fprintln(out, "        outer, r.end = r.end, end")
+		for idx, f := range s.Fields {
+			keyword := "elif"
+			if idx == 0 {
+				keyword = "if"
+			}
+			fmt.Fprintf(out, "        %s number == %d:\n", keyword, f.ID)
+			fmt.Fprintf(out, "            v[%q] = %s\n", f.Name, pythonExpr(f.Type, f.Name))
+		}
+		fmt.Fprintln(out, "        r.end, r.off = outer, end")
+	}
+
+	root := snakeCase(schema.Root)
+	fmt.Fprintln(out)
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "def unpack(data):")
+	fmt.Fprintf(out, "    return read_%s(Reader(data))\n", root)
+	fmt.Fprintln(out)
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "if __name__ == \"__main__\":")
+	fmt.Fprintln(out, "    print(json.dumps(unpack(sys.stdin.buffer.read()), default=list))")
+	return out.Bytes()
+}
+
+// pythonExpr is the expression reading the value of type t from the Reader r
+func pythonExpr(t schemaType, field string) string {
+	name := strconv.Quote(field)
+	switch {
+	case t.Encoding == "varint":
+		return "r.uvarint(" + name + ")"
+	case t.Encoding == "zigzag":
+		return "r.varint(" + name + ")"
+	}
+
+	size := strconv.Itoa(t.Count)
+	switch {
+	case nil != t.Length:
+		size = pythonExpr(*t.Length, field)
+	case t.Size > 0:
+		size = strconv.Itoa(t.Size)
+	}
+
+	switch t.Kind {
+	case "uint", "int", "float", "bool":
+		order := "<"
+		if t.Order == "be" {
+			order = ">"
+		}
+		return "r.number(\"" + order + pythonFormats[t.Kind+strconv.Itoa(t.Size)] + "\", " + name + ")"
+	case "string":
+		if t.Padding != "" {
+			return "r.padded(" + size + ", \"" + t.Padding + "\", " + name + ")"
+		}
+		return "r.string(" + size + ", " + name + ")"
+	case "bytes":
+		return "r.read(" + size + ", " + name + ")"
+	case "array":
+		return "[" + pythonExpr(*t.Elem, field) + " for _ in range(" + size + ")]"
+	case "struct":
+		return "read_" + snakeCase(t.Struct) + "(r)"
+	}
+	log.Fatalln("unsupported", t.Kind, "of", field, "in Python decoder")
+	return ""
+}
+
+// pythonDefault is the value of the field of a tagged struct missing in data
+func pythonDefault(f schemaField, schema schemaFile) string {
+	switch {
+	case f.Default == "":
+		return pythonZero(f.Type, schema)
+	case f.Type.Kind == "string":
+		return strconv.Quote(f.Default)
+	case f.Type.Kind == "bool":
+		value, _ := strconv.ParseBool(f.Default)
+		return map[bool]string{true: "True", false: "False"}[value]
+	}
+	return f.Default
+}
+
+// pythonZero is the zero value of type t like in Go,
+// a nested struct has the zero values of its fields
+func pythonZero(t schemaType, schema schemaFile) string {
+	switch t.Kind {
+	case "uint", "int":
+		return "0"
+	case "float":
+		return "0.0"
+	case "bool":
+		return "False"
+	case "string":
+		return "\"\""
+	case "bytes":
+		if nil == t.Length && t.Padding == "" {
+			return "bytes(" + strconv.Itoa(t.Size) + ")"
+		}
+		return "b\"\""
+	case "array":
+		if nil == t.Length {
+			return "[" + pythonZero(*t.Elem, schema) + " for _ in range(" + strconv.Itoa(t.Count) + ")]"
+		}
+		return "[]"
+	}
+	values := []string{}
+	for _, s := range schema.Structs {
+		if s.Name != t.Struct {
+			continue
+		}
+		for _, f := range s.Fields {
+			values = append(values, fmt.Sprintf("%q: %s", f.Name, pythonZero(f.Type, schema)))
+		}
+	}
+	return "{" + strings.Join(values, ", ") + "}"
+}
+
+// ksyAttr is an attribute of a Kaitai Struct type, the keys are kept in order
+type ksyAttr [][2]string
+
+type ksyType struct {
+	Name      string
+	Seq       []ksyAttr
+	Instances []ksyAttr
+}
+
+// ksyFile collects the types of the Kaitai Struct description
+type ksyFile struct {
+	Types  []*ksyType
+	Varint bool
+}
+
+// kaitaiStruct is the Kaitai Struct description of the root struct of the schema,
+// varints are the vlq_base128_le type of the Kaitai Struct formats library
+func kaitaiStruct(schema schemaFile) []byte {
+	k := &ksyFile{}
+	for _, s := range schema.Structs {
+		k.addStruct(s)
+	}
+
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "# Code generated by codegen from the binpack struct %s. DO NOT EDIT.\n", schema.Root)
+	fmt.Fprintln(out, "meta:")
+	fmt.Fprintln(out, "  id: "+snakeCase(schema.Root))
+	fmt.Fprintln(out, "  endian: le")
+	if k.Varint {
+		fmt.Fprintln(out, "  imports:")
+		fmt.Fprintln(out, "    - /common/vlq_base128_le")
+	}
+	if schema.Structs[0].Tagged {
+		fmt.Fprintln(out, "doc: |")
+		fmt.Fprintln(out, "  Fields missing in data are not read, Go sets them to the zero value or the default.")
+	}
+
+	root := k.Types[0]
+	writeKsyBody(out, root, "")
+	if len(k.Types) > 1 {
+		fmt.Fprintln(out, "types:")
+		for _, t := range k.Types[1:] {
+			fmt.Fprintln(out, "  "+t.Name+":")
+			writeKsyBody(out, t, "    ")
+		}
+	}
+	return out.Bytes()
+}
+
+func (k *ksyFile) newType(name string) *ksyType {
+	t := &ksyType{Name: name}
+	k.Types = append(k.Types, t)
+	return t
+}
+
+func (k *ksyFile) addStruct(s schemaStruct) {
+	name := snakeCase(s.Name)
+	t := k.newType(name)
+	if !s.Tagged {
+		for _, f := range s.Fields {
+			k.addValue(t, snakeCase(f.Name), f.Type, name+"_"+snakeCase(f.Name))
+		}
+		return
+	}
+
+	// number, length and value of the field, number 0 ends the struct
+	k.Varint = true
+	t.Seq = append(t.Seq, ksyAttr{{"id", "fields"}, {"type", name + "_field"}, {"repeat", "until"}, {"repeat-until", "_.number.value == 0"}})
+	field := k.newType(name + "_field")
+	cases := []string{}
+	for _, f := range s.Fields {
+		value := k.newType(name + "_" + snakeCase(f.Name) + "_value")
+		k.addValue(value, "value", f.Type, value.Name)
+		cases = append(cases, strconv.Itoa(f.ID)+": "+value.Name)
+	}
+	field.Seq = append(field.Seq,
+		ksyAttr{{"id", "number"}, {"type", "vlq_base128_le"}},
+		ksyAttr{{"id", "len_body"}, {"type", "vlq_base128_le"}, {"if", "number.value != 0"}},
+		// unknown fields are read as bytes
+		ksyAttr{{"id", "body"}, {"size", "len_body.value"}, {"if", "number.value != 0"}, {"type", "{switch-on: number.value, cases: {" + strings.Join(cases, ", ") + "}}"}},
+	)
+}
+
+// addValue adds the attributes of the value id of type t to typ,
+// the types made for its elements are named after prefix
+func (k *ksyFile) addValue(typ *ksyType, id string, t schemaType, prefix string) {
+	if attr, ok := k.simpleAttr(id, t); ok {
+		typ.Seq = append(typ.Seq, attr)
+		return
+	}
+
+	if t.Encoding == "zigzag" {
+		k.Varint = true
+		raw := "raw_" + id
+		typ.Seq = append(typ.Seq, ksyAttr{{"id", raw}, {"type", "vlq_base128_le"}})
+		typ.Instances = append(typ.Instances, ksyAttr{{"id", id}, {"value", "(" + raw + ".value >> 1) ^ -(" + raw + ".value & 1)"}})
+		return
+	}
+
+	size := strconv.Itoa(t.Count)
+	if nil != t.Length {
+		lenAttr, _ := k.simpleAttr("len_"+id, *t.Length)
+		typ.Seq = append(typ.Seq, lenAttr)
+		size = "len_" + id
+		if t.Length.Encoding == "varint" {
+			size += ".value"
+		}
+	}
+
+	switch t.Kind {
+	case "string":
+		typ.Seq = append(typ.Seq, ksyAttr{{"id", id}, {"type", "str"}, {"size", size}, {"encoding", "UTF-8"}})
+	case "bytes":
+		typ.Seq = append(typ.Seq, ksyAttr{{"id", id}, {"size", size}})
+	case "array":
+		elem, ok := k.simpleAttr(id, *t.Elem)
+		if !ok {
+			// elements of several attributes are wrapped into a type
+			wrapper := k.newType(prefix + "_elem")
+			k.addValue(wrapper, "value", *t.Elem, wrapper.Name)
+			elem = ksyAttr{{"id", id}, {"type", wrapper.Name}}
+		}
+		typ.Seq = append(typ.Seq, append(elem, [2]string{"repeat", "expr"}, [2]string{"repeat-expr", size}))
+	default:
+		log.Fatalln("unsupported", t.Kind, "of", id, "in Kaitai Struct")
+	}
+}
+
+// simpleAttr is the single attribute reading the value of type t, if there is one
+func (k *ksyFile) simpleAttr(id string, t schemaType) (ksyAttr, bool) {
+	switch {
+	case t.Encoding == "varint":
+		k.Varint = true
+		return ksyAttr{{"id", id}, {"type", "vlq_base128_le"}}, true
+	case t.Encoding != "":
+		return nil, false
+	}
+
+	switch t.Kind {
+	case "uint", "int", "float", "bool":
+		name := map[string]string{"uint": "u", "int": "s", "float": "f", "bool": "u"}[t.Kind] + strconv.Itoa(t.Size)
+		return ksyAttr{{"id", id}, {"type", name + t.Order}}, true
+	case "string":
+		switch t.Padding {
+		case "zero":
+			return ksyAttr{{"id", id}, {"type", "strz"}, {"size", strconv.Itoa(t.Size)}, {"encoding", "UTF-8"}}, true
+		case "space":
+			return ksyAttr{{"id", id}, {"type", "str"}, {"size", strconv.Itoa(t.Size)}, {"pad-right", "0x20"}, {"encoding", "UTF-8"}}, true
+		case "raw":
+			return ksyAttr{{"id", id}, {"type", "str"}, {"size", strconv.Itoa(t.Size)}, {"encoding", "UTF-8"}}, true
+		}
+	case "bytes":
+		if nil == t.Length {
+			return ksyAttr{{"id", id}, {"size", strconv.Itoa(t.Size)}}, true
+		}
+	case "struct":
+		return ksyAttr{{"id", id}, {"type", snakeCase(t.Struct)}}, true
+	}
+	return nil, false
+}
+
+var ksyPlain = regexp.MustCompile(`^([A-Za-z0-9_./-]+|\{.*\})$`)
+
+// ksyScalar quotes the expressions which are not plain YAML scalars
+func ksyScalar(value string) string {
+	if ksyPlain.MatchString(value) {
+		return value
+	}
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+func writeKsyBody(out *bytes.Buffer, t *ksyType, indent string) {
+	fmt.Fprintln(out, indent+"seq:")
+	for _, attr := range t.Seq {
+		for idx, kv := range attr {
+			marker := "    "
+			if idx == 0 {
+				marker = "  - "
+			}
+			fmt.Fprintln(out, indent+marker+kv[0]+": "+ksyScalar(kv[1]))
+		}
+	}
+	if len(t.Instances) == 0 {
+		return
+	}
+	fmt.Fprintln(out, indent+"instances:")
+	for _, attr := range t.Instances {
+		fmt.Fprintln(out, indent+"  "+attr[0][1]+":")
+		for _, kv := range attr[1:] {
+			fmt.Fprintln(out, indent+"    "+kv[0]+": "+ksyScalar(kv[1]))
+		}
+	}
+}
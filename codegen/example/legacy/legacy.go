@@ -0,0 +1,417 @@
+package legacy
+
+import "bufio"
+import "bytes"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "math"
+import "unsafe"
+
+// Legacy is generated from the pack template "C n N Z8 A4 a4 v/a* L2"
+// cgen: binpack template="C n N Z8 A4 a4 v/a* L2"
+type Legacy struct {
+	Version  uint8
+	Port     uint16
+	Address  uint32
+	Name     string
+	Code     string
+	Tag      string
+	Note     string
+	Counters [2]uint32
+}
+
+// ErrTruncated is the error of data ending inside a field
+var ErrTruncated = errors.New("truncated data")
+
+// ErrOverflow is the error of a varint not fitting the field
+var ErrOverflow = errors.New("value overflows the field")
+
+// ErrTrailingBytes is the error of UnpackStrict when data has bytes after the last field
+var ErrTrailingBytes = errors.New("trailing bytes")
+
+// UnpackError tells which field failed and where
+type UnpackError struct {
+	// Field is the path of the field, like Guests[1].Login
+	Field  string
+	Offset int64
+	Err    error
+}
+
+func (e *UnpackError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("unpack at offset %d: %v", e.Offset, e.Err)
+	}
+	return fmt.Sprintf("unpack %s at offset %d: %v", e.Field, e.Offset, e.Err)
+}
+
+func (e *UnpackError) Unwrap() error {
+	return e.Err
+}
+
+// unpackError puts the field in front of the path of the error of a nested struct
+func unpackError(field string, off int, err error) error {
+	if nested, ok := err.(*UnpackError); ok {
+		if nested.Field == "" {
+			nested.Field = field
+		} else {
+			nested.Field = field + "." + nested.Field
+		}
+		return nested
+	}
+	return &UnpackError{Field: field, Offset: int64(off), Err: err}
+}
+
+// varintError is the error of the size returned by binary.Uvarint and binary.Varint
+func varintError(size int) error {
+	if size == 0 {
+		return ErrTruncated
+	}
+	return ErrOverflow
+}
+
+// unsafeString is the string sharing memory with b
+func unsafeString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return unsafe.String(&b[0], len(b))
+}
+
+func writeUvarint(w *bytes.Buffer, value uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], value)])
+}
+
+func writeVarint(w *bytes.Buffer, value int64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutVarint(buf[:], value)])
+}
+
+// fieldHeader reads the number and the length of the field of a tagged struct at data[off:]
+// and returns the offsets of its value, number 0 ends the struct
+func fieldHeader(data []byte, off int) (uint64, int, int, error) {
+	id, size := binary.Uvarint(data[off:])
+	if size <= 0 {
+		return 0, off, off, &UnpackError{Offset: int64(off), Err: varintError(size)}
+	}
+	off += size
+	if id == 0 {
+		return 0, off, off, nil
+	}
+	length, size := binary.Uvarint(data[off:])
+	if size <= 0 {
+		return 0, off, off, &UnpackError{Offset: int64(off), Err: varintError(size)}
+	}
+	off += size
+	if length > uint64(len(data)-off) {
+		return 0, off, off, &UnpackError{Offset: int64(off), Err: ErrTruncated}
+	}
+	return id, off, off + int(length), nil
+}
+
+// endField puts the length of the field value written to w after start in front of it
+func endField(w *bytes.Buffer, start int) {
+	var prefix [binary.MaxVarintLen64]byte
+	size := binary.PutUvarint(prefix[:], uint64(w.Len()-start))
+	w.Write(prefix[:size])
+	b := w.Bytes()
+	copy(b[start+size:], b[start:len(b)-size])
+	copy(b[start:], prefix[:size])
+}
+
+// MaxFrameSize limits the length of a frame read by DecodeFrom and FrameReader,
+// so a corrupted length prefix does not allocate gigabytes
+var MaxFrameSize = 64 << 20
+
+// ErrFrameTooLarge is the error of a frame longer than MaxFrameSize
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// Record is a struct marked with cgen: binpack
+type Record interface {
+	packTo(w *bytes.Buffer) error
+	unpackFrom(data []byte, off int, alias bool) (int, error)
+}
+
+// writeFrame writes rec to w in one call, after its length as uvarint,
+// buf is reused between the records
+func writeFrame(w io.Writer, rec Record, buf *bytes.Buffer) error {
+	var prefix [binary.MaxVarintLen64]byte
+	buf.Reset()
+	buf.Write(prefix[:])
+	if err := rec.packTo(buf); nil != err {
+		return err
+	}
+	frame := buf.Bytes()
+	size := binary.PutUvarint(prefix[:], uint64(len(frame)-len(prefix)))
+	frame = frame[len(prefix)-size:]
+	copy(frame, prefix[:size])
+	_, err := w.Write(frame)
+	return err
+}
+
+type frameSource interface {
+	io.Reader
+	io.ByteReader
+}
+
+// byteReader reads the length prefix of a frame one byte at a time,
+// so nothing after the frame is taken from the reader
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+// readFrame reads the next frame from r into rec, buf is reused between the frames,
+// io.EOF tells the stream ended before the frame
+func readFrame(r frameSource, rec Record, buf []byte) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if nil != err {
+		return buf, err
+	}
+	if size > uint64(MaxFrameSize) {
+		return buf, ErrFrameTooLarge
+	}
+	if uint64(cap(buf)) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	if _, err := io.ReadFull(r, buf); nil != err {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return buf, err
+	}
+	off, err := rec.unpackFrom(buf, 0, false)
+	if nil != err {
+		return buf, err
+	}
+	if off < len(buf) {
+		return buf, &UnpackError{Offset: int64(off), Err: ErrTrailingBytes}
+	}
+	return buf, nil
+}
+
+// FrameWriter writes a sequence of records, each one after its length as uvarint
+type FrameWriter struct {
+	w   *bufio.Writer
+	buf bytes.Buffer
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: bufio.NewWriter(w)}
+}
+
+// Encode writes rec as the next frame, it is buffered until Flush
+func (fw *FrameWriter) Encode(rec Record) error {
+	return writeFrame(fw.w, rec, &fw.buf)
+}
+
+func (fw *FrameWriter) Flush() error {
+	return fw.w.Flush()
+}
+
+// FrameReader reads the records written by FrameWriter or EncodeTo,
+// only the current one is kept in memory
+type FrameReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next frame into rec, io.EOF tells there are no more frames
+func (fr *FrameReader) Decode(rec Record) error {
+	var err error
+	fr.buf, err = readFrame(fr.r, rec, fr.buf)
+	return err
+}
+
+func (in *Legacy) Unpack(data []byte) error {
+	_, err := in.unpackFrom(data, 0, false)
+	return err
+}
+
+// UnpackNoCopy is Unpack with strings and []byte sharing memory with data,
+// data must not change while they are in use
+func (in *Legacy) UnpackNoCopy(data []byte) error {
+	_, err := in.unpackFrom(data, 0, true)
+	return err
+}
+
+// UnpackStrict is Unpack failing with ErrTrailingBytes when data is longer than the struct
+func (in *Legacy) UnpackStrict(data []byte) error {
+	off, err := in.unpackFrom(data, 0, false)
+	if nil != err {
+		return err
+	}
+	if off < len(data) {
+		return &UnpackError{Offset: int64(off), Err: ErrTrailingBytes}
+	}
+	return nil
+}
+
+// unpackFrom reads the struct at data[off:] and returns the offset after it
+func (in *Legacy) unpackFrom(data []byte, off int, alias bool) (int, error) {
+	// Version
+	if len(data)-off < 1 {
+		return off, unpackError("Version", off, ErrTruncated)
+	}
+	in.Version = data[off]
+	off += 1
+
+	// Port
+	if len(data)-off < 2 {
+		return off, unpackError("Port", off, ErrTruncated)
+	}
+	in.Port = binary.BigEndian.Uint16(data[off:])
+	off += 2
+
+	// Address
+	if len(data)-off < 4 {
+		return off, unpackError("Address", off, ErrTruncated)
+	}
+	in.Address = binary.BigEndian.Uint32(data[off:])
+	off += 4
+
+	// Name
+	if len(data)-off < 8 {
+		return off, unpackError("Name", off, ErrTruncated)
+	}
+	NameRaw := data[off : off+8]
+	if end := bytes.IndexByte(NameRaw, 0); end >= 0 {
+		NameRaw = NameRaw[:end]
+	}
+	if alias {
+		in.Name = unsafeString(NameRaw)
+	} else {
+		in.Name = string(NameRaw)
+	}
+	off += 8
+
+	// Code
+	if len(data)-off < 4 {
+		return off, unpackError("Code", off, ErrTruncated)
+	}
+	CodeRaw := data[off : off+4]
+	CodeRaw = bytes.TrimRight(CodeRaw, "\x00 \t\n\r")
+	if alias {
+		in.Code = unsafeString(CodeRaw)
+	} else {
+		in.Code = string(CodeRaw)
+	}
+	off += 4
+
+	// Tag
+	if len(data)-off < 4 {
+		return off, unpackError("Tag", off, ErrTruncated)
+	}
+	TagRaw := data[off : off+4]
+	if alias {
+		in.Tag = unsafeString(TagRaw)
+	} else {
+		in.Tag = string(TagRaw)
+	}
+	off += 4
+
+	// Note
+	if len(data)-off < 2 {
+		return off, unpackError("Note", off, ErrTruncated)
+	}
+	NoteLenRaw := binary.LittleEndian.Uint16(data[off:])
+	off += 2
+	if uint64(NoteLenRaw) > uint64(len(data)-off) {
+		return off, unpackError("Note", off, ErrTruncated)
+	}
+	if alias {
+		in.Note = unsafeString(data[off : off+int(NoteLenRaw)])
+	} else {
+		in.Note = string(data[off : off+int(NoteLenRaw)])
+	}
+	off += int(NoteLenRaw)
+
+	// Counters
+	if len(data)-off < len(in.Counters)*4 {
+		return off, unpackError("Counters", off, ErrTruncated)
+	}
+	for i0 := range in.Counters {
+		in.Counters[i0] = binary.LittleEndian.Uint32(data[off:])
+		off += 4
+	}
+	return off, nil
+}
+
+func (in *Legacy) Pack() ([]byte, error) {
+	w := &bytes.Buffer{}
+	if err := in.packTo(w); nil != err {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func (in *Legacy) packTo(w *bytes.Buffer) error {
+	// Version
+	binary.Write(w, binary.LittleEndian, in.Version)
+
+	// Port
+	binary.Write(w, binary.BigEndian, in.Port)
+
+	// Address
+	binary.Write(w, binary.BigEndian, in.Address)
+
+	// Name
+	if len(in.Name) >= 8 {
+		return fmt.Errorf("Name: length %d does not fit 8 bytes with the terminating zero", len(in.Name))
+	}
+	w.WriteString(in.Name)
+	w.Write(make([]byte, 8-len(in.Name)))
+
+	// Code
+	if len(in.Code) > 4 {
+		return fmt.Errorf("Code: length %d does not fit 4 bytes", len(in.Code))
+	}
+	w.WriteString(in.Code)
+	w.Write(bytes.Repeat([]byte{' '}, 4-len(in.Code)))
+
+	// Tag
+	if len(in.Tag) > 4 {
+		return fmt.Errorf("Tag: length %d does not fit 4 bytes", len(in.Tag))
+	}
+	w.WriteString(in.Tag)
+	w.Write(make([]byte, 4-len(in.Tag)))
+
+	// Note
+	if uint64(len(in.Note)) > math.MaxUint16 {
+		return fmt.Errorf("Note: length %d does not fit uint16", len(in.Note))
+	}
+	binary.Write(w, binary.LittleEndian, uint16(len(in.Note)))
+	w.WriteString(in.Note)
+
+	// Counters
+	binary.Write(w, binary.LittleEndian, in.Counters)
+	return nil
+}
+
+// EncodeTo writes the struct to w as a frame, its length as uvarint and the bytes of Pack
+func (in *Legacy) EncodeTo(w io.Writer) error {
+	return writeFrame(w, in, &bytes.Buffer{})
+}
+
+// DecodeFrom reads the frame written by EncodeTo and nothing after it,
+// the length is read byte by byte unless r is an io.ByteReader like *bufio.Reader
+func (in *Legacy) DecodeFrom(r io.Reader) error {
+	src, ok := r.(frameSource)
+	if !ok {
+		src = byteReader{r}
+	}
+	_, err := readFrame(src, in, nil)
+	return err
+}
@@ -0,0 +1,77 @@
+package legacy
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// perl -E 'print pack("C n N Z8 A4 a4 v/a* L2", 1, 8080, 3232235777, "srv", "OK", "t\0", "hello", 7, 9)'
+var perlLegacy = []byte{
+	1,
+	31, 144,
+	192, 168, 1, 1,
+	115, 114, 118, 0, 0, 0, 0, 0,
+	79, 75, 32, 32,
+	116, 0, 0, 0,
+	5, 0, 104, 101, 108, 108, 111,
+	7, 0, 0, 0, 9, 0, 0, 0,
+}
+
+func TestTemplateLayout(t *testing.T) {
+	// A дополняется пробелами и теряет их при чтении, a хранит нулевые байты как есть
+	expected := Legacy{
+		Version:  1,
+		Port:     8080,
+		Address:  3232235777,
+		Name:     "srv",
+		Code:     "OK",
+		Tag:      "t\x00\x00\x00",
+		Note:     "hello",
+		Counters: [2]uint32{7, 9},
+	}
+
+	l := Legacy{}
+	if err := l.UnpackStrict(perlLegacy); nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(l, expected) {
+		t.Errorf("expected %#v, got %#v", expected, l)
+	}
+
+	expected.Tag = "t"
+	data, err := expected.Pack()
+	if nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(data, perlLegacy) {
+		t.Errorf("expected %v, got %v", perlLegacy, data)
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	cases := []struct {
+		Legacy   Legacy
+		Expected string
+	}{
+		{ // Z8 оставляет место под завершающий ноль
+			Legacy:   Legacy{Name: "12345678"},
+			Expected: "Name: length 8 does not fit 8 bytes with the terminating zero",
+		},
+		{
+			Legacy:   Legacy{Code: "TOOLONG"},
+			Expected: "Code: length 7 does not fit 4 bytes",
+		},
+		{ // длина v/a* - uint16
+			Legacy:   Legacy{Note: string(make([]byte, 1<<16))},
+			Expected: "Note: length 65536 does not fit uint16",
+		},
+	}
+
+	for idx, item := range cases {
+		_, err := item.Legacy.Pack()
+		if nil == err || err.Error() != item.Expected {
+			t.Errorf("[%d] expected %q, got %v", idx, item.Expected, err)
+		}
+	}
+}
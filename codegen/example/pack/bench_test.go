@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// unpackUserReader is the Unpack of User generated before the slice based one,
+// it reads data with bytes.Reader and binary.Read and is kept as the baseline
+func unpackUserReader(in *User, data []byte) error {
+	r := bytes.NewReader(data)
+	truncated := func(field string) error {
+		return &UnpackError{Field: field, Offset: r.Size() - int64(r.Len()), Err: ErrTruncated}
+	}
+
+	// ID
+	if r.Len() < 4 {
+		return truncated("ID")
+	}
+	var IDRaw uint32
+	binary.Read(r, binary.LittleEndian, &IDRaw)
+	in.ID = int(IDRaw)
+
+	// Login
+	if r.Len() < 4 {
+		return truncated("Login")
+	}
+	var LoginLenRaw uint32
+	binary.Read(r, binary.LittleEndian, &LoginLenRaw)
+	if uint64(LoginLenRaw) > uint64(r.Len()) {
+		return truncated("Login")
+	}
+	LoginRaw := make([]byte, LoginLenRaw)
+	r.Read(LoginRaw)
+	in.Login = string(LoginRaw)
+
+	// Flags
+	if r.Len() < 4 {
+		return truncated("Flags")
+	}
+	var FlagsRaw uint32
+	binary.Read(r, binary.LittleEndian, &FlagsRaw)
+	in.Flags = int(FlagsRaw)
+	return nil
+}
+
+func TestUnpackAllocs(t *testing.T) {
+	u := User{}
+	cases := []struct {
+		Name     string
+		Unpack   func() error
+		Expected float64
+	}{
+		{"Unpack", func() error { return u.Unpack(perlUser) }, 1}, // копия логина
+		{"UnpackNoCopy", func() error { return u.UnpackNoCopy(perlUser) }, 0},
+	}
+
+	for _, item := range cases {
+		allocs := testing.AllocsPerRun(100, func() {
+			if err := item.Unpack(); nil != err {
+				t.Fatal(err)
+			}
+		})
+		if allocs != item.Expected {
+			t.Errorf("%s: expected %v allocations, got %v", item.Name, item.Expected, allocs)
+		}
+	}
+}
+
+func TestUnpackNoCopy(t *testing.T) {
+	data := append([]byte{}, perlUser...)
+	u := User{}
+	if err := u.UnpackNoCopy(data); nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if u.Login != "v.romanov" {
+		t.Fatalf("unexpected login %q", u.Login)
+	}
+	// строка ссылается на data, копия при Unpack - нет
+	copied := User{}
+	copied.Unpack(data)
+	data[8] = 'V'
+	if u.Login != "V.romanov" || copied.Login != "v.romanov" {
+		t.Errorf("expected aliased %q and copied %q", u.Login, copied.Login)
+	}
+
+	// срез байт не может дописать данные за своей границей
+	s := Session{Payload: []byte{1, 2}, Ports: []uint16{3}}
+	packed, _ := s.Pack()
+	aliased := Session{}
+	if err := aliased.UnpackNoCopy(packed); nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cap(aliased.Payload) != 2 {
+		t.Errorf("expected capacity 2, got %d", cap(aliased.Payload))
+	}
+}
+
+func BenchmarkUnpackUserReader(b *testing.B) {
+	b.ReportAllocs()
+	u := User{}
+	for i := 0; i < b.N; i++ {
+		unpackUserReader(&u, perlUser)
+	}
+}
+
+func BenchmarkUnpackUser(b *testing.B) {
+	b.ReportAllocs()
+	u := User{}
+	for i := 0; i < b.N; i++ {
+		u.Unpack(perlUser)
+	}
+}
+
+func BenchmarkUnpackNoCopyUser(b *testing.B) {
+	b.ReportAllocs()
+	u := User{}
+	for i := 0; i < b.N; i++ {
+		u.UnpackNoCopy(perlUser)
+	}
+}
+
+func BenchmarkUnpackSession(b *testing.B) {
+	s := Session{
+		Owner:   User{ID: 1, Login: "v.romanov"},
+		Guests:  []User{{ID: 2, Login: "guest"}, {ID: 3, Login: "other"}},
+		Scopes:  []string{"read", "write"},
+		Payload: make([]byte, 256),
+		Ports:   []uint16{80, 443},
+	}
+	data, err := s.Pack()
+	if nil != err {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Unpack(data)
+	}
+}
+
+func BenchmarkPackUser(b *testing.B) {
+	b.ReportAllocs()
+	u := User{ID: 1123456, Login: "v.romanov", Flags: 16}
+	for i := 0; i < b.N; i++ {
+		u.Pack()
+	}
+}
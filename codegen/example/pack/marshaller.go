@@ -1,26 +1,1241 @@
 package main
 
-import "encoding/binary"
+import "bufio"
 import "bytes"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "math"
+import "unsafe"
+
+// ErrTruncated is the error of data ending inside a field
+var ErrTruncated = errors.New("truncated data")
+
+// ErrOverflow is the error of a varint not fitting the field
+var ErrOverflow = errors.New("value overflows the field")
+
+// ErrTrailingBytes is the error of UnpackStrict when data has bytes after the last field
+var ErrTrailingBytes = errors.New("trailing bytes")
+
+// UnpackError tells which field failed and where
+type UnpackError struct {
+	// Field is the path of the field, like Guests[1].Login
+	Field  string
+	Offset int64
+	Err    error
+}
+
+func (e *UnpackError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("unpack at offset %d: %v", e.Offset, e.Err)
+	}
+	return fmt.Sprintf("unpack %s at offset %d: %v", e.Field, e.Offset, e.Err)
+}
+
+func (e *UnpackError) Unwrap() error {
+	return e.Err
+}
+
+// unpackError puts the field in front of the path of the error of a nested struct
+func unpackError(field string, off int, err error) error {
+	if nested, ok := err.(*UnpackError); ok {
+		if nested.Field == "" {
+			nested.Field = field
+		} else {
+			nested.Field = field + "." + nested.Field
+		}
+		return nested
+	}
+	return &UnpackError{Field: field, Offset: int64(off), Err: err}
+}
+
+// varintError is the error of the size returned by binary.Uvarint and binary.Varint
+func varintError(size int) error {
+	if size == 0 {
+		return ErrTruncated
+	}
+	return ErrOverflow
+}
+
+// unsafeString is the string sharing memory with b
+func unsafeString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return unsafe.String(&b[0], len(b))
+}
+
+func writeUvarint(w *bytes.Buffer, value uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], value)])
+}
+
+func writeVarint(w *bytes.Buffer, value int64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutVarint(buf[:], value)])
+}
+
+// fieldHeader reads the number and the length of the field of a tagged struct at data[off:]
+// and returns the offsets of its value, number 0 ends the struct
+func fieldHeader(data []byte, off int) (uint64, int, int, error) {
+	id, size := binary.Uvarint(data[off:])
+	if size <= 0 {
+		return 0, off, off, &UnpackError{Offset: int64(off), Err: varintError(size)}
+	}
+	off += size
+	if id == 0 {
+		return 0, off, off, nil
+	}
+	length, size := binary.Uvarint(data[off:])
+	if size <= 0 {
+		return 0, off, off, &UnpackError{Offset: int64(off), Err: varintError(size)}
+	}
+	off += size
+	if length > uint64(len(data)-off) {
+		return 0, off, off, &UnpackError{Offset: int64(off), Err: ErrTruncated}
+	}
+	return id, off, off + int(length), nil
+}
+
+// endField puts the length of the field value written to w after start in front of it
+func endField(w *bytes.Buffer, start int) {
+	var prefix [binary.MaxVarintLen64]byte
+	size := binary.PutUvarint(prefix[:], uint64(w.Len()-start))
+	w.Write(prefix[:size])
+	b := w.Bytes()
+	copy(b[start+size:], b[start:len(b)-size])
+	copy(b[start:], prefix[:size])
+}
+
+// MaxFrameSize limits the length of a frame read by DecodeFrom and FrameReader,
+// so a corrupted length prefix does not allocate gigabytes
+var MaxFrameSize = 64 << 20
+
+// ErrFrameTooLarge is the error of a frame longer than MaxFrameSize
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// Record is a struct marked with cgen: binpack
+type Record interface {
+	packTo(w *bytes.Buffer) error
+	unpackFrom(data []byte, off int, alias bool) (int, error)
+}
+
+// writeFrame writes rec to w in one call, after its length as uvarint,
+// buf is reused between the records
+func writeFrame(w io.Writer, rec Record, buf *bytes.Buffer) error {
+	var prefix [binary.MaxVarintLen64]byte
+	buf.Reset()
+	buf.Write(prefix[:])
+	if err := rec.packTo(buf); nil != err {
+		return err
+	}
+	frame := buf.Bytes()
+	size := binary.PutUvarint(prefix[:], uint64(len(frame)-len(prefix)))
+	frame = frame[len(prefix)-size:]
+	copy(frame, prefix[:size])
+	_, err := w.Write(frame)
+	return err
+}
+
+type frameSource interface {
+	io.Reader
+	io.ByteReader
+}
+
+// byteReader reads the length prefix of a frame one byte at a time,
+// so nothing after the frame is taken from the reader
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+// readFrame reads the next frame from r into rec, buf is reused between the frames,
+// io.EOF tells the stream ended before the frame
+func readFrame(r frameSource, rec Record, buf []byte) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if nil != err {
+		return buf, err
+	}
+	if size > uint64(MaxFrameSize) {
+		return buf, ErrFrameTooLarge
+	}
+	if uint64(cap(buf)) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	if _, err := io.ReadFull(r, buf); nil != err {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return buf, err
+	}
+	off, err := rec.unpackFrom(buf, 0, false)
+	if nil != err {
+		return buf, err
+	}
+	if off < len(buf) {
+		return buf, &UnpackError{Offset: int64(off), Err: ErrTrailingBytes}
+	}
+	return buf, nil
+}
+
+// FrameWriter writes a sequence of records, each one after its length as uvarint
+type FrameWriter struct {
+	w   *bufio.Writer
+	buf bytes.Buffer
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: bufio.NewWriter(w)}
+}
+
+// Encode writes rec as the next frame, it is buffered until Flush
+func (fw *FrameWriter) Encode(rec Record) error {
+	return writeFrame(fw.w, rec, &fw.buf)
+}
+
+func (fw *FrameWriter) Flush() error {
+	return fw.w.Flush()
+}
+
+// FrameReader reads the records written by FrameWriter or EncodeTo,
+// only the current one is kept in memory
+type FrameReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next frame into rec, io.EOF tells there are no more frames
+func (fr *FrameReader) Decode(rec Record) error {
+	var err error
+	fr.buf, err = readFrame(fr.r, rec, fr.buf)
+	return err
+}
 
 func (in *User) Unpack(data []byte) error {
-	r := bytes.NewReader(data)
+	_, err := in.unpackFrom(data, 0, false)
+	return err
+}
 
+// UnpackNoCopy is Unpack with strings and []byte sharing memory with data,
+// data must not change while they are in use
+func (in *User) UnpackNoCopy(data []byte) error {
+	_, err := in.unpackFrom(data, 0, true)
+	return err
+}
+
+// UnpackStrict is Unpack failing with ErrTrailingBytes when data is longer than the struct
+func (in *User) UnpackStrict(data []byte) error {
+	off, err := in.unpackFrom(data, 0, false)
+	if nil != err {
+		return err
+	}
+	if off < len(data) {
+		return &UnpackError{Offset: int64(off), Err: ErrTrailingBytes}
+	}
+	return nil
+}
+
+// unpackFrom reads the struct at data[off:] and returns the offset after it
+func (in *User) unpackFrom(data []byte, off int, alias bool) (int, error) {
+	// ID
+	if len(data)-off < 4 {
+		return off, unpackError("ID", off, ErrTruncated)
+	}
+	in.ID = int(binary.LittleEndian.Uint32(data[off:]))
+	off += 4
+
+	// Login
+	if len(data)-off < 4 {
+		return off, unpackError("Login", off, ErrTruncated)
+	}
+	LoginLenRaw := binary.LittleEndian.Uint32(data[off:])
+	off += 4
+	if uint64(LoginLenRaw) > uint64(len(data)-off) {
+		return off, unpackError("Login", off, ErrTruncated)
+	}
+	if alias {
+		in.Login = unsafeString(data[off : off+int(LoginLenRaw)])
+	} else {
+		in.Login = string(data[off : off+int(LoginLenRaw)])
+	}
+	off += int(LoginLenRaw)
+
+	// Flags
+	if len(data)-off < 4 {
+		return off, unpackError("Flags", off, ErrTruncated)
+	}
+	in.Flags = int(binary.LittleEndian.Uint32(data[off:]))
+	off += 4
+	return off, nil
+}
+
+func (in *User) Pack() ([]byte, error) {
+	w := &bytes.Buffer{}
+	if err := in.packTo(w); nil != err {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func (in *User) packTo(w *bytes.Buffer) error {
 	// ID
-	var IDRaw uint32
-	binary.Read(r, binary.LittleEndian, &IDRaw)
-	in.ID = int(IDRaw)
+	if in.ID < 0 || uint64(in.ID) > math.MaxUint32 {
+		return fmt.Errorf("ID: %d does not fit uint32", in.ID)
+	}
+	binary.Write(w, binary.LittleEndian, uint32(in.ID))
 
 	// Login
-	var LoginLenRaw uint32
-	binary.Read(r, binary.LittleEndian, &LoginLenRaw)
-	LoginRaw := make([]byte, LoginLenRaw)
-	binary.Read(r, binary.LittleEndian, &LoginRaw)
-	in.Login = string(LoginRaw)
+	if uint64(len(in.Login)) > math.MaxUint32 {
+		return fmt.Errorf("Login: length %d does not fit uint32", len(in.Login))
+	}
+	binary.Write(w, binary.LittleEndian, uint32(len(in.Login)))
+	w.WriteString(in.Login)
 
 	// Flags
-	var FlagsRaw uint32
-	binary.Read(r, binary.LittleEndian, &FlagsRaw)
-	in.Flags = int(FlagsRaw)
+	if in.Flags < 0 || uint64(in.Flags) > math.MaxUint32 {
+		return fmt.Errorf("Flags: %d does not fit uint32", in.Flags)
+	}
+	binary.Write(w, binary.LittleEndian, uint32(in.Flags))
+	return nil
+}
+
+// EncodeTo writes the struct to w as a frame, its length as uvarint and the bytes of Pack
+func (in *User) EncodeTo(w io.Writer) error {
+	return writeFrame(w, in, &bytes.Buffer{})
+}
+
+// DecodeFrom reads the frame written by EncodeTo and nothing after it,
+// the length is read byte by byte unless r is an io.ByteReader like *bufio.Reader
+func (in *User) DecodeFrom(r io.Reader) error {
+	src, ok := r.(frameSource)
+	if !ok {
+		src = byteReader{r}
+	}
+	_, err := readFrame(src, in, nil)
+	return err
+}
+
+func (in *Session) Unpack(data []byte) error {
+	_, err := in.unpackFrom(data, 0, false)
+	return err
+}
+
+// UnpackNoCopy is Unpack with strings and []byte sharing memory with data,
+// data must not change while they are in use
+func (in *Session) UnpackNoCopy(data []byte) error {
+	_, err := in.unpackFrom(data, 0, true)
+	return err
+}
+
+// UnpackStrict is Unpack failing with ErrTrailingBytes when data is longer than the struct
+func (in *Session) UnpackStrict(data []byte) error {
+	off, err := in.unpackFrom(data, 0, false)
+	if nil != err {
+		return err
+	}
+	if off < len(data) {
+		return &UnpackError{Offset: int64(off), Err: ErrTrailingBytes}
+	}
+	return nil
+}
+
+// unpackFrom reads the struct at data[off:] and returns the offset after it
+func (in *Session) unpackFrom(data []byte, off int, alias bool) (int, error) {
+	// ID
+	if len(data)-off < 8 {
+		return off, unpackError("ID", off, ErrTruncated)
+	}
+	in.ID = binary.LittleEndian.Uint64(data[off:])
+	off += 8
+
+	// Owner
+	OwnerEnd, err := in.Owner.unpackFrom(data, off, alias)
+	if nil != err {
+		return OwnerEnd, unpackError("Owner", off, err)
+	}
+	off = OwnerEnd
+
+	// Guests
+	if len(data)-off < 4 {
+		return off, unpackError("Guests", off, ErrTruncated)
+	}
+	GuestsLenRaw := binary.LittleEndian.Uint32(data[off:])
+	off += 4
+	if uint64(GuestsLenRaw) > uint64(len(data)-off)/12 {
+		return off, unpackError("Guests", off, ErrTruncated)
+	}
+	in.Guests = make([]User, GuestsLenRaw)
+	for i0 := range in.Guests {
+		GuestsElemEnd, err := in.Guests[i0].unpackFrom(data, off, alias)
+		if nil != err {
+			return GuestsElemEnd, unpackError(fmt.Sprintf("Guests[%d]", i0), off, err)
+		}
+		off = GuestsElemEnd
+	}
+
+	// Scopes
+	if len(data)-off < 4 {
+		return off, unpackError("Scopes", off, ErrTruncated)
+	}
+	ScopesLenRaw := binary.LittleEndian.Uint32(data[off:])
+	off += 4
+	if uint64(ScopesLenRaw) > uint64(len(data)-off)/4 {
+		return off, unpackError("Scopes", off, ErrTruncated)
+	}
+	in.Scopes = make([]string, ScopesLenRaw)
+	for i0 := range in.Scopes {
+		if len(data)-off < 4 {
+			return off, unpackError(fmt.Sprintf("Scopes[%d]", i0), off, ErrTruncated)
+		}
+		ScopesElemLenRaw := binary.LittleEndian.Uint32(data[off:])
+		off += 4
+		if uint64(ScopesElemLenRaw) > uint64(len(data)-off) {
+			return off, unpackError(fmt.Sprintf("Scopes[%d]", i0), off, ErrTruncated)
+		}
+		if alias {
+			in.Scopes[i0] = unsafeString(data[off : off+int(ScopesElemLenRaw)])
+		} else {
+			in.Scopes[i0] = string(data[off : off+int(ScopesElemLenRaw)])
+		}
+		off += int(ScopesElemLenRaw)
+	}
+
+	// Token
+	if len(data)-off < len(in.Token) {
+		return off, unpackError("Token", off, ErrTruncated)
+	}
+	copy(in.Token[:], data[off:])
+	off += len(in.Token)
+
+	// Payload
+	if len(data)-off < 4 {
+		return off, unpackError("Payload", off, ErrTruncated)
+	}
+	PayloadLenRaw := binary.LittleEndian.Uint32(data[off:])
+	off += 4
+	if uint64(PayloadLenRaw) > uint64(len(data)-off) {
+		return off, unpackError("Payload", off, ErrTruncated)
+	}
+	if alias {
+		in.Payload = data[off : off+int(PayloadLenRaw) : off+int(PayloadLenRaw)]
+	} else {
+		in.Payload = make([]byte, PayloadLenRaw)
+		copy(in.Payload, data[off:])
+	}
+	off += int(PayloadLenRaw)
+
+	// Ports
+	if len(data)-off < 4 {
+		return off, unpackError("Ports", off, ErrTruncated)
+	}
+	PortsLenRaw := binary.LittleEndian.Uint32(data[off:])
+	off += 4
+	if uint64(PortsLenRaw) > uint64(len(data)-off)/2 {
+		return off, unpackError("Ports", off, ErrTruncated)
+	}
+	in.Ports = make([]uint16, PortsLenRaw)
+	for i0 := range in.Ports {
+		in.Ports[i0] = binary.LittleEndian.Uint16(data[off:])
+		off += 2
+	}
+
+	// Expires
+	if len(data)-off < 8 {
+		return off, unpackError("Expires", off, ErrTruncated)
+	}
+	in.Expires = int64(binary.LittleEndian.Uint64(data[off:]))
+	off += 8
+
+	// Active
+	if len(data)-off < 1 {
+		return off, unpackError("Active", off, ErrTruncated)
+	}
+	in.Active = data[off] != 0
+	off += 1
+
+	// Rating
+	if len(data)-off < 8 {
+		return off, unpackError("Rating", off, ErrTruncated)
+	}
+	in.Rating = math.Float64frombits(binary.LittleEndian.Uint64(data[off:]))
+	off += 8
+
+	// Grid
+	for i0 := range in.Grid {
+		if len(data)-off < len(in.Grid[i0]) {
+			return off, unpackError(fmt.Sprintf("Grid[%d]", i0), off, ErrTruncated)
+		}
+		for i1 := range in.Grid[i0] {
+			in.Grid[i0][i1] = int8(data[off])
+			off += 1
+		}
+	}
+	return off, nil
+}
+
+func (in *Session) Pack() ([]byte, error) {
+	w := &bytes.Buffer{}
+	if err := in.packTo(w); nil != err {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func (in *Session) packTo(w *bytes.Buffer) error {
+	// ID
+	binary.Write(w, binary.LittleEndian, in.ID)
+
+	// Owner
+	if err := in.Owner.packTo(w); nil != err {
+		return err
+	}
+
+	// Guests
+	if uint64(len(in.Guests)) > math.MaxUint32 {
+		return fmt.Errorf("Guests: length %d does not fit uint32", len(in.Guests))
+	}
+	binary.Write(w, binary.LittleEndian, uint32(len(in.Guests)))
+	for i0 := range in.Guests {
+		if err := in.Guests[i0].packTo(w); nil != err {
+			return err
+		}
+	}
+
+	// Scopes
+	if uint64(len(in.Scopes)) > math.MaxUint32 {
+		return fmt.Errorf("Scopes: length %d does not fit uint32", len(in.Scopes))
+	}
+	binary.Write(w, binary.LittleEndian, uint32(len(in.Scopes)))
+	for i0 := range in.Scopes {
+		if uint64(len(in.Scopes[i0])) > math.MaxUint32 {
+			return fmt.Errorf("ScopesElem: length %d does not fit uint32", len(in.Scopes[i0]))
+		}
+		binary.Write(w, binary.LittleEndian, uint32(len(in.Scopes[i0])))
+		w.WriteString(in.Scopes[i0])
+	}
+
+	// Token
+	binary.Write(w, binary.LittleEndian, in.Token)
+
+	// Payload
+	if uint64(len(in.Payload)) > math.MaxUint32 {
+		return fmt.Errorf("Payload: length %d does not fit uint32", len(in.Payload))
+	}
+	binary.Write(w, binary.LittleEndian, uint32(len(in.Payload)))
+	binary.Write(w, binary.LittleEndian, in.Payload)
+
+	// Ports
+	if uint64(len(in.Ports)) > math.MaxUint32 {
+		return fmt.Errorf("Ports: length %d does not fit uint32", len(in.Ports))
+	}
+	binary.Write(w, binary.LittleEndian, uint32(len(in.Ports)))
+	binary.Write(w, binary.LittleEndian, in.Ports)
+
+	// Expires
+	binary.Write(w, binary.LittleEndian, in.Expires)
+
+	// Active
+	binary.Write(w, binary.LittleEndian, in.Active)
+
+	// Rating
+	binary.Write(w, binary.LittleEndian, in.Rating)
+
+	// Grid
+	for i0 := range in.Grid {
+		binary.Write(w, binary.LittleEndian, in.Grid[i0])
+	}
 	return nil
 }
+
+// EncodeTo writes the struct to w as a frame, its length as uvarint and the bytes of Pack
+func (in *Session) EncodeTo(w io.Writer) error {
+	return writeFrame(w, in, &bytes.Buffer{})
+}
+
+// DecodeFrom reads the frame written by EncodeTo and nothing after it,
+// the length is read byte by byte unless r is an io.ByteReader like *bufio.Reader
+func (in *Session) DecodeFrom(r io.Reader) error {
+	src, ok := r.(frameSource)
+	if !ok {
+		src = byteReader{r}
+	}
+	_, err := readFrame(src, in, nil)
+	return err
+}
+
+func (in *Packet) Unpack(data []byte) error {
+	_, err := in.unpackFrom(data, 0, false)
+	return err
+}
+
+// UnpackNoCopy is Unpack with strings and []byte sharing memory with data,
+// data must not change while they are in use
+func (in *Packet) UnpackNoCopy(data []byte) error {
+	_, err := in.unpackFrom(data, 0, true)
+	return err
+}
+
+// UnpackStrict is Unpack failing with ErrTrailingBytes when data is longer than the struct
+func (in *Packet) UnpackStrict(data []byte) error {
+	off, err := in.unpackFrom(data, 0, false)
+	if nil != err {
+		return err
+	}
+	if off < len(data) {
+		return &UnpackError{Offset: int64(off), Err: ErrTrailingBytes}
+	}
+	return nil
+}
+
+// unpackFrom reads the struct at data[off:] and returns the offset after it
+func (in *Packet) unpackFrom(data []byte, off int, alias bool) (int, error) {
+	// Version
+	if len(data)-off < 1 {
+		return off, unpackError("Version", off, ErrTruncated)
+	}
+	in.Version = data[off]
+	off += 1
+
+	// Flags
+	if len(data)-off < 2 {
+		return off, unpackError("Flags", off, ErrTruncated)
+	}
+	in.Flags = binary.BigEndian.Uint16(data[off:])
+	off += 2
+
+	// Sequence
+	if len(data)-off < 4 {
+		return off, unpackError("Sequence", off, ErrTruncated)
+	}
+	in.Sequence = int(binary.BigEndian.Uint32(data[off:]))
+	off += 4
+
+	// Name
+	if len(data)-off < 8 {
+		return off, unpackError("Name", off, ErrTruncated)
+	}
+	NameRaw := data[off : off+8]
+	if end := bytes.IndexByte(NameRaw, 0); end >= 0 {
+		NameRaw = NameRaw[:end]
+	}
+	if alias {
+		in.Name = unsafeString(NameRaw)
+	} else {
+		in.Name = string(NameRaw)
+	}
+	off += 8
+
+	// Tags
+	if len(data)-off < 1 {
+		return off, unpackError("Tags", off, ErrTruncated)
+	}
+	TagsLenRaw := data[off]
+	off += 1
+	if uint64(TagsLenRaw) > uint64(len(data)-off) {
+		return off, unpackError("Tags", off, ErrTruncated)
+	}
+	in.Tags = make([]string, TagsLenRaw)
+	for i0 := range in.Tags {
+		if len(data)-off < 1 {
+			return off, unpackError(fmt.Sprintf("Tags[%d]", i0), off, ErrTruncated)
+		}
+		TagsElemLenRaw := data[off]
+		off += 1
+		if uint64(TagsElemLenRaw) > uint64(len(data)-off) {
+			return off, unpackError(fmt.Sprintf("Tags[%d]", i0), off, ErrTruncated)
+		}
+		if alias {
+			in.Tags[i0] = unsafeString(data[off : off+int(TagsElemLenRaw)])
+		} else {
+			in.Tags[i0] = string(data[off : off+int(TagsElemLenRaw)])
+		}
+		off += int(TagsElemLenRaw)
+	}
+
+	// Payload
+	PayloadLenRaw, PayloadLenSize := binary.Uvarint(data[off:])
+	if PayloadLenSize <= 0 {
+		return off, unpackError("Payload", off, varintError(PayloadLenSize))
+	}
+	off += PayloadLenSize
+	if uint64(PayloadLenRaw) > uint64(len(data)-off) {
+		return off, unpackError("Payload", off, ErrTruncated)
+	}
+	if alias {
+		in.Payload = data[off : off+int(PayloadLenRaw) : off+int(PayloadLenRaw)]
+	} else {
+		in.Payload = make([]byte, PayloadLenRaw)
+		copy(in.Payload, data[off:])
+	}
+	off += int(PayloadLenRaw)
+
+	// Checksum
+	if len(data)-off < 4 {
+		return off, unpackError("Checksum", off, ErrTruncated)
+	}
+	in.Checksum = binary.LittleEndian.Uint32(data[off:])
+	off += 4
+	return off, nil
+}
+
+func (in *Packet) Pack() ([]byte, error) {
+	w := &bytes.Buffer{}
+	if err := in.packTo(w); nil != err {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func (in *Packet) packTo(w *bytes.Buffer) error {
+	// Version
+	binary.Write(w, binary.BigEndian, in.Version)
+
+	// Flags
+	binary.Write(w, binary.BigEndian, in.Flags)
+
+	// Sequence
+	if in.Sequence < 0 || uint64(in.Sequence) > math.MaxUint32 {
+		return fmt.Errorf("Sequence: %d does not fit uint32", in.Sequence)
+	}
+	binary.Write(w, binary.BigEndian, uint32(in.Sequence))
+
+	// Name
+	if len(in.Name) > 8 {
+		return fmt.Errorf("Name: length %d does not fit 8 bytes", len(in.Name))
+	}
+	w.WriteString(in.Name)
+	w.Write(make([]byte, 8-len(in.Name)))
+
+	// Tags
+	if uint64(len(in.Tags)) > math.MaxUint8 {
+		return fmt.Errorf("Tags: length %d does not fit uint8", len(in.Tags))
+	}
+	binary.Write(w, binary.BigEndian, uint8(len(in.Tags)))
+	for i0 := range in.Tags {
+		if uint64(len(in.Tags[i0])) > math.MaxUint8 {
+			return fmt.Errorf("TagsElem: length %d does not fit uint8", len(in.Tags[i0]))
+		}
+		binary.Write(w, binary.BigEndian, uint8(len(in.Tags[i0])))
+		w.WriteString(in.Tags[i0])
+	}
+
+	// Payload
+	writeUvarint(w, uint64(len(in.Payload)))
+	binary.Write(w, binary.BigEndian, in.Payload)
+
+	// Checksum
+	binary.Write(w, binary.LittleEndian, in.Checksum)
+	return nil
+}
+
+// EncodeTo writes the struct to w as a frame, its length as uvarint and the bytes of Pack
+func (in *Packet) EncodeTo(w io.Writer) error {
+	return writeFrame(w, in, &bytes.Buffer{})
+}
+
+// DecodeFrom reads the frame written by EncodeTo and nothing after it,
+// the length is read byte by byte unless r is an io.ByteReader like *bufio.Reader
+func (in *Packet) DecodeFrom(r io.Reader) error {
+	src, ok := r.(frameSource)
+	if !ok {
+		src = byteReader{r}
+	}
+	_, err := readFrame(src, in, nil)
+	return err
+}
+
+func (in *Event) Unpack(data []byte) error {
+	_, err := in.unpackFrom(data, 0, false)
+	return err
+}
+
+// UnpackNoCopy is Unpack with strings and []byte sharing memory with data,
+// data must not change while they are in use
+func (in *Event) UnpackNoCopy(data []byte) error {
+	_, err := in.unpackFrom(data, 0, true)
+	return err
+}
+
+// UnpackStrict is Unpack failing with ErrTrailingBytes when data is longer than the struct
+func (in *Event) UnpackStrict(data []byte) error {
+	off, err := in.unpackFrom(data, 0, false)
+	if nil != err {
+		return err
+	}
+	if off < len(data) {
+		return &UnpackError{Offset: int64(off), Err: ErrTrailingBytes}
+	}
+	return nil
+}
+
+// unpackFrom reads the struct at data[off:] and returns the offset after it
+func (in *Event) unpackFrom(data []byte, off int, alias bool) (int, error) {
+	// ID
+	IDRaw, IDSize := binary.Uvarint(data[off:])
+	if IDSize <= 0 {
+		return off, unpackError("ID", off, varintError(IDSize))
+	}
+	in.ID = uint64(IDRaw)
+	off += IDSize
+
+	// Kind
+	KindRaw, KindSize := binary.Uvarint(data[off:])
+	if KindSize <= 0 {
+		return off, unpackError("Kind", off, varintError(KindSize))
+	}
+	if KindRaw > math.MaxUint16 {
+		return off, unpackError("Kind", off, ErrOverflow)
+	}
+	in.Kind = uint16(KindRaw)
+	off += KindSize
+
+	// Delta
+	DeltaRaw, DeltaSize := binary.Varint(data[off:])
+	if DeltaSize <= 0 {
+		return off, unpackError("Delta", off, varintError(DeltaSize))
+	}
+	if DeltaRaw < math.MinInt || DeltaRaw > math.MaxInt {
+		return off, unpackError("Delta", off, ErrOverflow)
+	}
+	in.Delta = int(DeltaRaw)
+	off += DeltaSize
+
+	// Offsets
+	if len(data)-off < 4 {
+		return off, unpackError("Offsets", off, ErrTruncated)
+	}
+	OffsetsLenRaw := binary.LittleEndian.Uint32(data[off:])
+	off += 4
+	if uint64(OffsetsLenRaw) > uint64(len(data)-off) {
+		return off, unpackError("Offsets", off, ErrTruncated)
+	}
+	in.Offsets = make([]int32, OffsetsLenRaw)
+	for i0 := range in.Offsets {
+		OffsetsElemRaw, OffsetsElemSize := binary.Varint(data[off:])
+		if OffsetsElemSize <= 0 {
+			return off, unpackError(fmt.Sprintf("Offsets[%d]", i0), off, varintError(OffsetsElemSize))
+		}
+		if OffsetsElemRaw < math.MinInt32 || OffsetsElemRaw > math.MaxInt32 {
+			return off, unpackError(fmt.Sprintf("Offsets[%d]", i0), off, ErrOverflow)
+		}
+		in.Offsets[i0] = int32(OffsetsElemRaw)
+		off += OffsetsElemSize
+	}
+
+	// Mask
+	if len(data)-off < 4 {
+		return off, unpackError("Mask", off, ErrTruncated)
+	}
+	in.Mask = binary.LittleEndian.Uint32(data[off:])
+	off += 4
+
+	// Level
+	if len(data)-off < 1 {
+		return off, unpackError("Level", off, ErrTruncated)
+	}
+	in.Level = int8(data[off])
+	off += 1
+
+	// Payload
+	if len(data)-off < 4 {
+		return off, unpackError("Payload", off, ErrTruncated)
+	}
+	PayloadLenRaw := binary.LittleEndian.Uint32(data[off:])
+	off += 4
+	if uint64(PayloadLenRaw) > uint64(len(data)-off) {
+		return off, unpackError("Payload", off, ErrTruncated)
+	}
+	if alias {
+		in.Payload = data[off : off+int(PayloadLenRaw) : off+int(PayloadLenRaw)]
+	} else {
+		in.Payload = make([]byte, PayloadLenRaw)
+		copy(in.Payload, data[off:])
+	}
+	off += int(PayloadLenRaw)
+	return off, nil
+}
+
+func (in *Event) Pack() ([]byte, error) {
+	w := &bytes.Buffer{}
+	if err := in.packTo(w); nil != err {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func (in *Event) packTo(w *bytes.Buffer) error {
+	// ID
+	writeUvarint(w, uint64(in.ID))
+
+	// Kind
+	writeUvarint(w, uint64(in.Kind))
+
+	// Delta
+	writeVarint(w, int64(in.Delta))
+
+	// Offsets
+	if uint64(len(in.Offsets)) > math.MaxUint32 {
+		return fmt.Errorf("Offsets: length %d does not fit uint32", len(in.Offsets))
+	}
+	binary.Write(w, binary.LittleEndian, uint32(len(in.Offsets)))
+	for i0 := range in.Offsets {
+		writeVarint(w, int64(in.Offsets[i0]))
+	}
+
+	// Mask
+	binary.Write(w, binary.LittleEndian, in.Mask)
+
+	// Level
+	binary.Write(w, binary.LittleEndian, in.Level)
+
+	// Payload
+	if uint64(len(in.Payload)) > math.MaxUint32 {
+		return fmt.Errorf("Payload: length %d does not fit uint32", len(in.Payload))
+	}
+	binary.Write(w, binary.LittleEndian, uint32(len(in.Payload)))
+	binary.Write(w, binary.LittleEndian, in.Payload)
+	return nil
+}
+
+// EncodeTo writes the struct to w as a frame, its length as uvarint and the bytes of Pack
+func (in *Event) EncodeTo(w io.Writer) error {
+	return writeFrame(w, in, &bytes.Buffer{})
+}
+
+// DecodeFrom reads the frame written by EncodeTo and nothing after it,
+// the length is read byte by byte unless r is an io.ByteReader like *bufio.Reader
+func (in *Event) DecodeFrom(r io.Reader) error {
+	src, ok := r.(frameSource)
+	if !ok {
+		src = byteReader{r}
+	}
+	_, err := readFrame(src, in, nil)
+	return err
+}
+
+func (in *Profile) Unpack(data []byte) error {
+	_, err := in.unpackFrom(data, 0, false)
+	return err
+}
+
+// UnpackNoCopy is Unpack with strings and []byte sharing memory with data,
+// data must not change while they are in use
+func (in *Profile) UnpackNoCopy(data []byte) error {
+	_, err := in.unpackFrom(data, 0, true)
+	return err
+}
+
+// UnpackStrict is Unpack failing with ErrTrailingBytes when data is longer than the struct
+func (in *Profile) UnpackStrict(data []byte) error {
+	off, err := in.unpackFrom(data, 0, false)
+	if nil != err {
+		return err
+	}
+	if off < len(data) {
+		return &UnpackError{Offset: int64(off), Err: ErrTrailingBytes}
+	}
+	return nil
+}
+
+// unpackFrom reads the struct at data[off:] and returns the offset after it
+func (in *Profile) unpackFrom(data []byte, off int, alias bool) (int, error) {
+	*in = Profile{Flags: 16}
+	for {
+		id, start, end, err := fieldHeader(data, off)
+		if nil != err {
+			return off, err
+		}
+		if id == 0 {
+			return end, nil
+		}
+		off = start
+		switch id {
+		case 1: // ID
+			data := data[:end]
+			if len(data)-off < 4 {
+				return off, unpackError("ID", off, ErrTruncated)
+			}
+			in.ID = int(binary.LittleEndian.Uint32(data[off:]))
+			off += 4
+		case 2: // Login
+			data := data[:end]
+			if len(data)-off < 4 {
+				return off, unpackError("Login", off, ErrTruncated)
+			}
+			LoginLenRaw := binary.LittleEndian.Uint32(data[off:])
+			off += 4
+			if uint64(LoginLenRaw) > uint64(len(data)-off) {
+				return off, unpackError("Login", off, ErrTruncated)
+			}
+			if alias {
+				in.Login = unsafeString(data[off : off+int(LoginLenRaw)])
+			} else {
+				in.Login = string(data[off : off+int(LoginLenRaw)])
+			}
+			off += int(LoginLenRaw)
+		case 4: // Flags
+			data := data[:end]
+			if len(data)-off < 4 {
+				return off, unpackError("Flags", off, ErrTruncated)
+			}
+			in.Flags = int(binary.LittleEndian.Uint32(data[off:]))
+			off += 4
+		}
+		off = end
+	}
+}
+
+func (in *Profile) Pack() ([]byte, error) {
+	w := &bytes.Buffer{}
+	if err := in.packTo(w); nil != err {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func (in *Profile) packTo(w *bytes.Buffer) error {
+	// ID
+	writeUvarint(w, 1)
+	IDStart := w.Len()
+	if in.ID < 0 || uint64(in.ID) > math.MaxUint32 {
+		return fmt.Errorf("ID: %d does not fit uint32", in.ID)
+	}
+	binary.Write(w, binary.LittleEndian, uint32(in.ID))
+	endField(w, IDStart)
+
+	// Login
+	writeUvarint(w, 2)
+	LoginStart := w.Len()
+	if uint64(len(in.Login)) > math.MaxUint32 {
+		return fmt.Errorf("Login: length %d does not fit uint32", len(in.Login))
+	}
+	binary.Write(w, binary.LittleEndian, uint32(len(in.Login)))
+	w.WriteString(in.Login)
+	endField(w, LoginStart)
+
+	// Flags
+	writeUvarint(w, 4)
+	FlagsStart := w.Len()
+	if in.Flags < 0 || uint64(in.Flags) > math.MaxUint32 {
+		return fmt.Errorf("Flags: %d does not fit uint32", in.Flags)
+	}
+	binary.Write(w, binary.LittleEndian, uint32(in.Flags))
+	endField(w, FlagsStart)
+
+	w.WriteByte(0)
+	return nil
+}
+
+// EncodeTo writes the struct to w as a frame, its length as uvarint and the bytes of Pack
+func (in *Profile) EncodeTo(w io.Writer) error {
+	return writeFrame(w, in, &bytes.Buffer{})
+}
+
+// DecodeFrom reads the frame written by EncodeTo and nothing after it,
+// the length is read byte by byte unless r is an io.ByteReader like *bufio.Reader
+func (in *Profile) DecodeFrom(r io.Reader) error {
+	src, ok := r.(frameSource)
+	if !ok {
+		src = byteReader{r}
+	}
+	_, err := readFrame(src, in, nil)
+	return err
+}
+
+func (in *ProfileV2) Unpack(data []byte) error {
+	_, err := in.unpackFrom(data, 0, false)
+	return err
+}
+
+// UnpackNoCopy is Unpack with strings and []byte sharing memory with data,
+// data must not change while they are in use
+func (in *ProfileV2) UnpackNoCopy(data []byte) error {
+	_, err := in.unpackFrom(data, 0, true)
+	return err
+}
+
+// UnpackStrict is Unpack failing with ErrTrailingBytes when data is longer than the struct
+func (in *ProfileV2) UnpackStrict(data []byte) error {
+	off, err := in.unpackFrom(data, 0, false)
+	if nil != err {
+		return err
+	}
+	if off < len(data) {
+		return &UnpackError{Offset: int64(off), Err: ErrTrailingBytes}
+	}
+	return nil
+}
+
+// unpackFrom reads the struct at data[off:] and returns the offset after it
+func (in *ProfileV2) unpackFrom(data []byte, off int, alias bool) (int, error) {
+	*in = ProfileV2{Cached: in.Cached, Flags: 16}
+	for {
+		id, start, end, err := fieldHeader(data, off)
+		if nil != err {
+			return off, err
+		}
+		if id == 0 {
+			return end, nil
+		}
+		off = start
+		switch id {
+		case 1: // ID
+			data := data[:end]
+			if len(data)-off < 4 {
+				return off, unpackError("ID", off, ErrTruncated)
+			}
+			in.ID = int(binary.LittleEndian.Uint32(data[off:]))
+			off += 4
+		case 4: // Flags
+			data := data[:end]
+			if len(data)-off < 4 {
+				return off, unpackError("Flags", off, ErrTruncated)
+			}
+			in.Flags = int(binary.LittleEndian.Uint32(data[off:]))
+			off += 4
+		case 5: // Email
+			data := data[:end]
+			if len(data)-off < 4 {
+				return off, unpackError("Email", off, ErrTruncated)
+			}
+			EmailLenRaw := binary.LittleEndian.Uint32(data[off:])
+			off += 4
+			if uint64(EmailLenRaw) > uint64(len(data)-off) {
+				return off, unpackError("Email", off, ErrTruncated)
+			}
+			if alias {
+				in.Email = unsafeString(data[off : off+int(EmailLenRaw)])
+			} else {
+				in.Email = string(data[off : off+int(EmailLenRaw)])
+			}
+			off += int(EmailLenRaw)
+		case 6: // Owner
+			data := data[:end]
+			OwnerEnd, err := in.Owner.unpackFrom(data, off, alias)
+			if nil != err {
+				return OwnerEnd, unpackError("Owner", off, err)
+			}
+			off = OwnerEnd
+		case 7: // Scopes
+			data := data[:end]
+			if len(data)-off < 1 {
+				return off, unpackError("Scopes", off, ErrTruncated)
+			}
+			ScopesLenRaw := data[off]
+			off += 1
+			if uint64(ScopesLenRaw) > uint64(len(data)-off) {
+				return off, unpackError("Scopes", off, ErrTruncated)
+			}
+			in.Scopes = make([]string, ScopesLenRaw)
+			for i0 := range in.Scopes {
+				if len(data)-off < 1 {
+					return off, unpackError(fmt.Sprintf("Scopes[%d]", i0), off, ErrTruncated)
+				}
+				ScopesElemLenRaw := data[off]
+				off += 1
+				if uint64(ScopesElemLenRaw) > uint64(len(data)-off) {
+					return off, unpackError(fmt.Sprintf("Scopes[%d]", i0), off, ErrTruncated)
+				}
+				if alias {
+					in.Scopes[i0] = unsafeString(data[off : off+int(ScopesElemLenRaw)])
+				} else {
+					in.Scopes[i0] = string(data[off : off+int(ScopesElemLenRaw)])
+				}
+				off += int(ScopesElemLenRaw)
+			}
+		}
+		off = end
+	}
+}
+
+func (in *ProfileV2) Pack() ([]byte, error) {
+	w := &bytes.Buffer{}
+	if err := in.packTo(w); nil != err {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func (in *ProfileV2) packTo(w *bytes.Buffer) error {
+	// ID
+	writeUvarint(w, 1)
+	IDStart := w.Len()
+	if in.ID < 0 || uint64(in.ID) > math.MaxUint32 {
+		return fmt.Errorf("ID: %d does not fit uint32", in.ID)
+	}
+	binary.Write(w, binary.LittleEndian, uint32(in.ID))
+	endField(w, IDStart)
+
+	// Flags
+	writeUvarint(w, 4)
+	FlagsStart := w.Len()
+	if in.Flags < 0 || uint64(in.Flags) > math.MaxUint32 {
+		return fmt.Errorf("Flags: %d does not fit uint32", in.Flags)
+	}
+	binary.Write(w, binary.LittleEndian, uint32(in.Flags))
+	endField(w, FlagsStart)
+
+	// Email
+	writeUvarint(w, 5)
+	EmailStart := w.Len()
+	if uint64(len(in.Email)) > math.MaxUint32 {
+		return fmt.Errorf("Email: length %d does not fit uint32", len(in.Email))
+	}
+	binary.Write(w, binary.LittleEndian, uint32(len(in.Email)))
+	w.WriteString(in.Email)
+	endField(w, EmailStart)
+
+	// Owner
+	writeUvarint(w, 6)
+	OwnerStart := w.Len()
+	if err := in.Owner.packTo(w); nil != err {
+		return err
+	}
+	endField(w, OwnerStart)
+
+	// Scopes
+	writeUvarint(w, 7)
+	ScopesStart := w.Len()
+	if uint64(len(in.Scopes)) > math.MaxUint8 {
+		return fmt.Errorf("Scopes: length %d does not fit uint8", len(in.Scopes))
+	}
+	binary.Write(w, binary.LittleEndian, uint8(len(in.Scopes)))
+	for i0 := range in.Scopes {
+		if uint64(len(in.Scopes[i0])) > math.MaxUint8 {
+			return fmt.Errorf("ScopesElem: length %d does not fit uint8", len(in.Scopes[i0]))
+		}
+		binary.Write(w, binary.LittleEndian, uint8(len(in.Scopes[i0])))
+		w.WriteString(in.Scopes[i0])
+	}
+	endField(w, ScopesStart)
+
+	w.WriteByte(0)
+	return nil
+}
+
+// EncodeTo writes the struct to w as a frame, its length as uvarint and the bytes of Pack
+func (in *ProfileV2) EncodeTo(w io.Writer) error {
+	return writeFrame(w, in, &bytes.Buffer{})
+}
+
+// DecodeFrom reads the frame written by EncodeTo and nothing after it,
+// the length is read byte by byte unless r is an io.ByteReader like *bufio.Reader
+func (in *ProfileV2) DecodeFrom(r io.Reader) error {
+	src, ok := r.(frameSource)
+	if !ok {
+		src = byteReader{r}
+	}
+	_, err := readFrame(src, in, nil)
+	return err
+}
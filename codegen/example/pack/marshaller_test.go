@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// perl -E 'print pack("L L/a* L", 1_123_456, "v.romanov", 16)'
+var perlUser = []byte{
+	128, 36, 17, 0,
+
+	9, 0, 0, 0,
+	118, 46, 114, 111, 109, 97, 110, 111, 118,
+
+	16, 0, 0, 0,
+}
+
+func TestPackRoundTrip(t *testing.T) {
+	cases := []User{
+		{ID: 1123456, Login: "v.romanov", Flags: 16},
+		{},
+		{ID: math.MaxUint32, Login: "юникод", Flags: 1},
+		{ID: 1, Login: string(make([]byte, 1000))},
+	}
+
+	for idx, item := range cases {
+		data, err := item.Pack()
+		if nil != err {
+			t.Fatalf("[%d] unexpected error: %v", idx, err)
+		}
+		u := User{}
+		if err := u.Unpack(data); nil != err {
+			t.Fatalf("[%d] unexpected error: %v", idx, err)
+		}
+		if !reflect.DeepEqual(u, item) {
+			t.Errorf("[%d] expected %#v, got %#v", idx, item, u)
+		}
+	}
+}
+
+func TestPackLayout(t *testing.T) {
+	// RealName помечен cgen:"-" и в данные не попадает
+	u := User{ID: 1123456, RealName: "Василий Романов", Login: "v.romanov", Flags: 16}
+	data, err := u.Pack()
+	if nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(data, perlUser) {
+		t.Errorf("expected %v, got %v", perlUser, data)
+	}
+}
+
+func TestPackOverflow(t *testing.T) {
+	cases := []User{
+		{ID: -1},
+		{Flags: math.MaxUint32 + 1},
+	}
+
+	for idx, item := range cases {
+		if _, err := item.Pack(); nil == err {
+			t.Errorf("[%d] expected error", idx)
+		}
+	}
+
+	// ошибка вложенной структуры доходит до Pack
+	s := Session{Guests: []User{{ID: 1}, {ID: -1}}}
+	if _, err := s.Pack(); nil == err {
+		t.Errorf("expected error of the nested struct")
+	}
+}
+
+func TestPackSessionRoundTrip(t *testing.T) {
+	cases := []Session{
+		{ // пустые срезы распаковываются в срезы нулевой длины
+			Guests:  []User{},
+			Scopes:  []string{},
+			Payload: []byte{},
+			Ports:   []uint16{},
+		},
+		{
+			ID:      math.MaxUint64,
+			Owner:   User{ID: 1123456, Login: "v.romanov", Flags: 16},
+			Guests:  []User{{ID: 1, Login: "guest"}, {ID: 2, Flags: 3}},
+			Scopes:  []string{"read", "", "write"},
+			Token:   [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			Payload: []byte{0, 255, 128},
+			Ports:   []uint16{80, 443, 65535},
+			Expires: -1,
+			Active:  true,
+			Rating:  -3.25,
+			Grid:    [2][3]int8{{-128, 0, 127}, {1, 2, 3}},
+		},
+	}
+
+	for idx, item := range cases {
+		data, err := item.Pack()
+		if nil != err {
+			t.Fatalf("[%d] unexpected error: %v", idx, err)
+		}
+		s := Session{}
+		if err := s.Unpack(data); nil != err {
+			t.Fatalf("[%d] unexpected error: %v", idx, err)
+		}
+		if !reflect.DeepEqual(s, item) {
+			t.Errorf("[%d] expected %#v, got %#v", idx, item, s)
+		}
+	}
+}
+
+func TestUnpackErrors(t *testing.T) {
+	cases := []struct {
+		Data   []byte
+		Strict bool
+		Field  string
+		Offset int64
+		Err    error
+	}{
+		{
+			Data:   perlUser[:3],
+			Field:  "ID",
+			Offset: 0,
+			Err:    ErrTruncated,
+		},
+		{ // длина строки больше оставшихся данных
+			Data:   perlUser[:12],
+			Field:  "Login",
+			Offset: 8,
+			Err:    ErrTruncated,
+		},
+		{
+			Data:   perlUser[:len(perlUser)-1],
+			Field:  "Flags",
+			Offset: 17,
+			Err:    ErrTruncated,
+		},
+		{ // огромный префикс длины не приводит к выделению памяти
+			Data:   []byte{1, 0, 0, 0, 255, 255, 255, 255},
+			Field:  "Login",
+			Offset: 8,
+			Err:    ErrTruncated,
+		},
+		{
+			Data:   append(append([]byte{}, perlUser...), 0),
+			Strict: true,
+			Offset: 21,
+			Err:    ErrTrailingBytes,
+		},
+	}
+
+	for idx, item := range cases {
+		u := User{}
+		err := u.Unpack(item.Data)
+		if item.Strict {
+			if nil != err {
+				t.Fatalf("[%d] unexpected error of non-strict unpack: %v", idx, err)
+			}
+			err = u.UnpackStrict(item.Data)
+		}
+		if !errors.Is(err, item.Err) {
+			t.Errorf("[%d] expected %v, got %v", idx, item.Err, err)
+			continue
+		}
+		unpackErr, ok := err.(*UnpackError)
+		if !ok {
+			t.Errorf("[%d] expected *UnpackError, got %T", idx, err)
+			continue
+		}
+		if unpackErr.Field != item.Field || unpackErr.Offset != item.Offset {
+			t.Errorf("[%d] expected %s at %d, got %s at %d", idx, item.Field, item.Offset, unpackErr.Field, unpackErr.Offset)
+		}
+	}
+}
+
+func TestUnpackNestedErrors(t *testing.T) {
+	s := Session{Guests: []User{{ID: 1, Login: "first"}, {ID: 2, Login: "second"}}}
+	data, err := s.Pack()
+	if nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// данные обрываются посреди логина второго гостя
+	// ID 8, Owner 12, длина Guests 4, первый гость 17, ID второго 4, длина логина 4
+	offset := 8 + 12 + 4 + 17 + 4 + 4
+	err = (&Session{}).Unpack(data[:offset+3])
+	expected := "unpack Guests[1].Login at offset 49: truncated data"
+	if nil == err || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+	if err := (&Session{}).UnpackStrict(data); nil != err {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPackOptionsLayout(t *testing.T) {
+	p := Packet{
+		Version:  1,
+		Flags:    0x0203,
+		Sequence: 0x04050607,
+		Name:     "eth0",
+		Tags:     []string{"a", "bc"},
+		Payload:  []byte{0xAA, 0xBB, 0xCC},
+		Checksum: 0x11223344,
+	}
+	expected := []byte{
+		1,    // Version
+		2, 3, // Flags, big-endian
+		4, 5, 6, 7, // Sequence, big-endian
+		'e', 't', 'h', '0', 0, 0, 0, 0, // Name, дополнен нулями до 8 байт
+		2,      // Tags, префикс u8
+		1, 'a', // префикс элементов тоже u8
+		2, 'b', 'c',
+		3, 0xAA, 0xBB, 0xCC, // Payload, префикс varint
+		0x44, 0x33, 0x22, 0x11, // Checksum, little-endian
+	}
+
+	data, err := p.Pack()
+	if nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("expected %v, got %v", expected, data)
+	}
+
+	unpacked := Packet{}
+	if err := unpacked.UnpackStrict(data); nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(unpacked, p) {
+		t.Errorf("expected %#v, got %#v", p, unpacked)
+	}
+}
+
+func TestPackOptionsRoundTrip(t *testing.T) {
+	cases := []Packet{
+		{Name: "", Tags: []string{}, Payload: []byte{}},
+		{ // имя во весь размер, длинный varint
+			Name:    "12345678",
+			Tags:    []string{string(make([]byte, 255))},
+			Payload: make([]byte, 300),
+		},
+	}
+
+	for idx, item := range cases {
+		data, err := item.Pack()
+		if nil != err {
+			t.Fatalf("[%d] unexpected error: %v", idx, err)
+		}
+		p := Packet{}
+		if err := p.Unpack(data); nil != err {
+			t.Fatalf("[%d] unexpected error: %v", idx, err)
+		}
+		if !reflect.DeepEqual(p, item) {
+			t.Errorf("[%d] expected %#v, got %#v", idx, item, p)
+		}
+	}
+}
+
+func TestPackOptionsErrors(t *testing.T) {
+	cases := []Packet{
+		{Name: "123456789"},
+		{Tags: make([]string, 256)},
+		{Tags: []string{string(make([]byte, 256))}},
+	}
+
+	for idx, item := range cases {
+		if _, err := item.Pack(); nil == err {
+			t.Errorf("[%d] expected error", idx)
+		}
+	}
+
+	// varint обрывается на байте с установленным старшим битом
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x80}
+	err := (&Packet{}).Unpack(data)
+	unpackErr, ok := err.(*UnpackError)
+	if !ok || unpackErr.Field != "Payload" || !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected truncated Payload, got %v", err)
+	}
+}
+
+func TestPackVarintLayout(t *testing.T) {
+	e := Event{ID: 300, Kind: 7, Delta: -2, Offsets: []int32{-1, 64}, Mask: 1, Level: -1, Payload: []byte{9}}
+
+	// формат совпадает с binary.PutUvarint и binary.PutVarint
+	expected := binary.AppendUvarint(nil, 300)
+	expected = binary.AppendUvarint(expected, 7)
+	expected = binary.AppendVarint(expected, -2)
+	expected = append(expected, 2, 0, 0, 0)
+	expected = binary.AppendVarint(expected, -1)
+	expected = binary.AppendVarint(expected, 64)
+	expected = append(expected, 1, 0, 0, 0) // Mask помечен fixed
+	expected = append(expected, 0xFF)       // однобайтовые числа не кодируются varint
+	expected = append(expected, 1, 0, 0, 0, 9)
+
+	data, err := e.Pack()
+	if nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("expected %v, got %v", expected, data)
+	}
+	// ID, Kind и Delta занимают 4 байта вместо 16
+	if !bytes.Equal(data[:4], []byte{0xAC, 0x02, 7, 3}) {
+		t.Errorf("unexpected varints %v", data[:4])
+	}
+}
+
+func TestPackVarintRoundTrip(t *testing.T) {
+	cases := []Event{
+		{Offsets: []int32{}, Payload: []byte{}},
+		{
+			ID:      math.MaxUint64,
+			Kind:    math.MaxUint16,
+			Delta:   math.MinInt64,
+			Offsets: []int32{math.MinInt32, math.MaxInt32, 0},
+			Mask:    math.MaxUint32,
+			Level:   math.MinInt8,
+			Payload: []byte{1, 2},
+		},
+	}
+
+	for idx, item := range cases {
+		data, err := item.Pack()
+		if nil != err {
+			t.Fatalf("[%d] unexpected error: %v", idx, err)
+		}
+		e := Event{}
+		if err := e.UnpackStrict(data); nil != err {
+			t.Fatalf("[%d] unexpected error: %v", idx, err)
+		}
+		if !reflect.DeepEqual(e, item) {
+			t.Errorf("[%d] expected %#v, got %#v", idx, item, e)
+		}
+	}
+}
+
+func TestUnpackVarintErrors(t *testing.T) {
+	cases := []struct {
+		Data  []byte
+		Field string
+		Err   error
+	}{
+		{ // 70000 не помещается в uint16
+			Data:  binary.AppendUvarint([]byte{1}, 70000),
+			Field: "Kind",
+			Err:   ErrOverflow,
+		},
+		{
+			Data:  []byte{1, 0x80},
+			Field: "Kind",
+			Err:   ErrTruncated,
+		},
+		{
+			Data:  append([]byte{1, 1, 0, 1, 0, 0, 0}, binary.AppendVarint(nil, math.MaxInt32+1)...),
+			Field: "Offsets[0]",
+			Err:   ErrOverflow,
+		},
+	}
+
+	for idx, item := range cases {
+		err := (&Event{}).Unpack(item.Data)
+		unpackErr, ok := err.(*UnpackError)
+		if !ok || unpackErr.Field != item.Field || !errors.Is(err, item.Err) {
+			t.Errorf("[%d] expected %v of %s, got %v", idx, item.Err, item.Field, err)
+		}
+	}
+}
+
+func TestFrameStream(t *testing.T) {
+	records := []Record{
+		&User{ID: 1123456, Login: "v.romanov", Flags: 16},
+		&Packet{Version: 2, Name: "ping", Tags: []string{"a"}, Payload: []byte{1}},
+		&User{},
+		&Event{ID: 300, Delta: -1, Offsets: []int32{1, -1}, Payload: []byte{2}},
+	}
+
+	stream := &bytes.Buffer{}
+	fw := NewFrameWriter(stream)
+	for idx, rec := range records {
+		if err := fw.Encode(rec); nil != err {
+			t.Fatalf("[%d] unexpected error: %v", idx, err)
+		}
+	}
+	// до Flush всё лежит в буфере
+	if stream.Len() != 0 {
+		t.Fatalf("expected nothing before Flush, got %d bytes", stream.Len())
+	}
+	if err := fw.Flush(); nil != err {
+		t.Fatal(err)
+	}
+
+	// кадр - длина varint и байты Pack
+	expected := append([]byte{byte(len(perlUser))}, perlUser...)
+	if !bytes.HasPrefix(stream.Bytes(), expected) {
+		t.Errorf("expected frame %v, got %v", expected, stream.Bytes()[:len(expected)])
+	}
+
+	fr := NewFrameReader(stream)
+	decoded := []Record{&User{}, &Packet{}, &User{}, &Event{}}
+	for idx, rec := range decoded {
+		if err := fr.Decode(rec); nil != err {
+			t.Fatalf("[%d] unexpected error: %v", idx, err)
+		}
+		if !reflect.DeepEqual(rec, records[idx]) {
+			t.Errorf("[%d] expected %#v, got %#v", idx, records[idx], rec)
+		}
+	}
+	if err := fr.Decode(&User{}); err != io.EOF {
+		t.Errorf("expected io.EOF after the last frame, got %v", err)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	first := User{ID: 1, Login: "first"}
+	second := Session{
+		Owner:   User{ID: 2, Login: "second"},
+		Guests:  []User{{ID: 3}},
+		Scopes:  []string{"read"},
+		Payload: []byte{1, 2},
+		Ports:   []uint16{80},
+	}
+
+	// как из сокета: без io.ByteReader и без буфера целиком
+	r, w := io.Pipe()
+	go func() {
+		first.EncodeTo(w)
+		second.EncodeTo(w)
+		w.Close()
+	}()
+
+	u := User{}
+	if err := u.DecodeFrom(r); nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// DecodeFrom не читает дальше своего кадра
+	s := Session{}
+	if err := s.DecodeFrom(r); nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(u, first) || !reflect.DeepEqual(s, second) {
+		t.Errorf("expected %#v and %#v, got %#v and %#v", first, second, u, s)
+	}
+}
+
+func TestDecodeFrameErrors(t *testing.T) {
+	long := append([]byte{byte(len(perlUser) + 1)}, perlUser...)
+	cases := []struct {
+		Data     []byte
+		Expected error
+	}{
+		{ // пустой поток
+			Data:     []byte{},
+			Expected: io.EOF,
+		},
+		{ // поток оборвался в длине кадра
+			Data:     []byte{0x80},
+			Expected: io.ErrUnexpectedEOF,
+		},
+		{ // поток оборвался в кадре
+			Data:     append([]byte{byte(len(perlUser))}, perlUser[:10]...),
+			Expected: io.ErrUnexpectedEOF,
+		},
+		{ // кадр короче структуры
+			Data:     append([]byte{byte(len(perlUser) - 1)}, perlUser...),
+			Expected: ErrTruncated,
+		},
+		{ // кадр длиннее структуры
+			Data:     append(long, 0),
+			Expected: ErrTrailingBytes,
+		},
+		{
+			Data:     []byte{0xff, 0xff, 0xff, 0xff, 0x0f},
+			Expected: ErrFrameTooLarge,
+		},
+	}
+
+	for idx, item := range cases {
+		u := User{}
+		if err := u.DecodeFrom(bytes.NewReader(item.Data)); !errors.Is(err, item.Expected) {
+			t.Errorf("[%d] expected %v, got %v", idx, item.Expected, err)
+		}
+		if err := NewFrameReader(bytes.NewReader(item.Data)).Decode(&u); !errors.Is(err, item.Expected) {
+			t.Errorf("[%d] expected %v from FrameReader, got %v", idx, item.Expected, err)
+		}
+	}
+}
+
+func TestPackTaggedLayout(t *testing.T) {
+	p := Profile{ID: 1, Login: "ab", Flags: 16}
+	data, err := p.Pack()
+	if nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// номер поля, длина значения, значение, в конце номер 0
+	expected := []byte{
+		1, 4, 1, 0, 0, 0,
+		2, 6, 2, 0, 0, 0, 'a', 'b',
+		4, 4, 16, 0, 0, 0,
+		0,
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("expected %v, got %v", expected, data)
+	}
+}
+
+func TestUnpackTaggedVersions(t *testing.T) {
+	// старая версия читает новую: Email, Owner и Scopes пропускаются
+	v2 := ProfileV2{ID: 7, Flags: 1, Email: "a@b.c", Owner: User{ID: 2, Login: "owner"}, Scopes: []string{"read"}}
+	data, err := v2.Pack()
+	if nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	v1 := Profile{Login: "stale"}
+	if err := v1.UnpackStrict(data); nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := (Profile{ID: 7, Flags: 1}); v1 != expected {
+		t.Errorf("expected %#v, got %#v", expected, v1)
+	}
+
+	// новая версия читает старую: Login пропускается, новые поля пустые
+	data, err = (&Profile{ID: 8, Login: "old", Flags: 2}).Pack()
+	if nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	v2 = ProfileV2{Email: "stale", Cached: true}
+	if err := v2.UnpackStrict(data); nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// поле с cgen:"-" не трогается
+	expected := ProfileV2{ID: 8, Flags: 2, Cached: true}
+	if !reflect.DeepEqual(v2, expected) {
+		t.Errorf("expected %#v, got %#v", expected, v2)
+	}
+
+	// отсутствующее поле получает значение по умолчанию
+	v1 = Profile{}
+	if err := v1.Unpack([]byte{1, 4, 9, 0, 0, 0, 0}); nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := (Profile{ID: 9, Flags: 16}); v1 != expected {
+		t.Errorf("expected %#v, got %#v", expected, v1)
+	}
+}
+
+func TestUnpackTaggedErrors(t *testing.T) {
+	cases := []struct {
+		Data     []byte
+		Expected string
+	}{
+		{ // нет номера 0 в конце
+			Data:     []byte{1, 4, 1, 0, 0, 0},
+			Expected: "unpack at offset 6: truncated data",
+		},
+		{ // длина поля за концом данных
+			Data:     []byte{9, 5, 1, 0},
+			Expected: "unpack at offset 2: truncated data",
+		},
+		{ // значение длиннее своего поля
+			Data:     []byte{1, 2, 1, 0, 0, 0, 0},
+			Expected: "unpack ID at offset 2: truncated data",
+		},
+		{
+			Data:     []byte{6, 3, 1, 0, 0, 0},
+			Expected: "unpack Owner.ID at offset 2: truncated data",
+		},
+	}
+
+	for idx, item := range cases {
+		v2 := ProfileV2{}
+		err := v2.Unpack(item.Data)
+		if nil == err || err.Error() != item.Expected {
+			t.Errorf("[%d] expected %q, got %v", idx, item.Expected, err)
+		}
+	}
+}
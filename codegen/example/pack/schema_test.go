@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSchemaPythonDecoder(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if nil != err {
+		t.Skip("python3 is not installed")
+	}
+
+	cases := []struct {
+		Decoder  string
+		Record   Record
+		Expected string
+	}{
+		{
+			Decoder:  "schema/user.py",
+			Record:   &User{ID: 1123456, Login: "v.romanov", Flags: 16},
+			Expected: `{"ID": 1123456, "Login": "v.romanov", "Flags": 16}`,
+		},
+		{
+			Decoder: "schema/session.py",
+			Record: &Session{
+				ID:      1,
+				Owner:   User{ID: 2, Login: "owner"},
+				Guests:  []User{{ID: 3, Login: "guest"}},
+				Scopes:  []string{"read", "write"},
+				Token:   [16]byte{1},
+				Payload: []byte{4, 5},
+				Ports:   []uint16{443},
+				Expires: -1,
+				Active:  true,
+				Rating:  4.5,
+				Grid:    [2][3]int8{{1, -1}, {0, 0, 2}},
+			},
+			Expected: `{
+				"ID": 1, "Owner": {"ID": 2, "Login": "owner", "Flags": 0},
+				"Guests": [{"ID": 3, "Login": "guest", "Flags": 0}], "Scopes": ["read", "write"],
+				"Token": [1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0], "Payload": [4, 5], "Ports": [443],
+				"Expires": -1, "Active": true, "Rating": 4.5, "Grid": [[1, -1, 0], [0, 0, 2]]
+			}`,
+		},
+		{ // big endian, строка фиксированного размера и префиксы разной ширины
+			Decoder:  "schema/packet.py",
+			Record:   &Packet{Version: 1, Flags: 2, Sequence: 3, Name: "ping", Tags: []string{"a"}, Payload: []byte{7}, Checksum: 9},
+			Expected: `{"Version": 1, "Flags": 2, "Sequence": 3, "Name": "ping", "Tags": ["a"], "Payload": [7], "Checksum": 9}`,
+		},
+		{
+			Decoder:  "schema/event.py",
+			Record:   &Event{ID: 300, Kind: 2, Delta: -3, Offsets: []int32{-1, 64}, Mask: 5, Level: -2, Payload: []byte{1}},
+			Expected: `{"ID": 300, "Kind": 2, "Delta": -3, "Offsets": [-1, 64], "Mask": 5, "Level": -2, "Payload": [1]}`,
+		},
+		{ // новая версия пропускает Login старой, Flags по умолчанию, вложенная структура нулевая, как в Go
+			Decoder:  "schema/profile_v2.py",
+			Record:   &Profile{ID: 8, Login: "old", Flags: 2},
+			Expected: `{"ID": 8, "Flags": 2, "Email": "", "Owner": {"ID": 0, "Login": "", "Flags": 0}, "Scopes": []}`,
+		},
+		{
+			Decoder:  "schema/profile.py",
+			Record:   &ProfileV2{ID: 7, Email: "a@b.c", Owner: User{ID: 2}, Scopes: []string{"x"}},
+			Expected: `{"ID": 7, "Login": "", "Flags": 0}`,
+		},
+	}
+
+	for idx, item := range cases {
+		data, err := item.Record.(interface{ Pack() ([]byte, error) }).Pack()
+		if nil != err {
+			t.Fatalf("[%d] unexpected error: %v", idx, err)
+		}
+		cmd := exec.Command(python, item.Decoder)
+		cmd.Stdin = bytes.NewReader(data)
+		out, err := cmd.CombinedOutput()
+		if nil != err {
+			t.Fatalf("[%d] %s failed: %v\n%s", idx, item.Decoder, err, out)
+		}
+
+		var got, expected interface{}
+		if err := json.Unmarshal(out, &got); nil != err {
+			t.Fatalf("[%d] bad output %q: %v", idx, out, err)
+		}
+		json.Unmarshal([]byte(item.Expected), &expected)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("[%d] expected %v, got %v", idx, expected, got)
+		}
+	}
+}
+
+func TestSchemaPythonErrors(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if nil != err {
+		t.Skip("python3 is not installed")
+	}
+
+	// как и Unpack, декодер называет поле и смещение
+	cmd := exec.Command(python, "schema/user.py")
+	cmd.Stdin = bytes.NewReader(perlUser[:10])
+	out, err := cmd.CombinedOutput()
+	expected := []byte("unpack Login at offset 8: truncated data")
+	if nil == err || !bytes.Contains(out, expected) {
+		t.Errorf("expected %q, got %v %q", expected, err, out)
+	}
+}
+
+// kaitaiBuiltin are the types of Kaitai Struct itself, the rest must be declared in types
+var kaitaiBuiltin = regexp.MustCompile(`^([us][1248](le|be)?|u1|s1|f[48](le|be)|strz?|vlq_base128_le)$`)
+
+func TestSchemaKaitaiStruct(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if nil != err {
+		t.Skip("python3 is not installed")
+	}
+	if err := exec.Command(python, "-c", "import yaml").Run(); nil != err {
+		t.Skip("python3 has no yaml module")
+	}
+
+	files, _ := filepath.Glob("schema/*.ksy")
+	if len(files) == 0 {
+		t.Fatal("no .ksy files in schema")
+	}
+	for _, name := range files {
+		// YAML читает python, дальше описание проверяется как JSON
+		data, err := ioutil.ReadFile(name)
+		if nil != err {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		cmd := exec.Command(python, "-c", "import json, sys, yaml; print(json.dumps(yaml.safe_load(sys.stdin)))")
+		cmd.Stdin = bytes.NewReader(data)
+		out, err := cmd.CombinedOutput()
+		if nil != err {
+			t.Errorf("%s is not YAML: %v\n%s", name, err, out)
+			continue
+		}
+
+		type attr struct {
+			ID   string      `json:"id"`
+			Type interface{} `json:"type"`
+		}
+		ksy := struct {
+			Meta  struct{ ID string } `json:"meta"`
+			Seq   []attr              `json:"seq"`
+			Types map[string]struct {
+				Seq []attr `json:"seq"`
+			} `json:"types"`
+		}{}
+		if err := json.Unmarshal(out, &ksy); nil != err {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if id := strings.TrimSuffix(filepath.Base(name), ".ksy"); ksy.Meta.ID != id {
+			t.Errorf("%s: expected meta id %q, got %q", name, id, ksy.Meta.ID)
+		}
+		if len(ksy.Seq) == 0 {
+			t.Errorf("%s: empty seq", name)
+		}
+		// каждый тип поля встроенный или объявлен в types,
+		// switch-on тагированных структур перечисляет их в cases
+		seqs := [][]attr{ksy.Seq}
+		for _, typ := range ksy.Types {
+			seqs = append(seqs, typ.Seq)
+		}
+		for _, seq := range seqs {
+			for _, a := range seq {
+				for _, typ := range kaitaiTypes(a.Type) {
+					if _, ok := ksy.Types[typ]; !ok && !kaitaiBuiltin.MatchString(typ) {
+						t.Errorf("%s: field %s has undeclared type %s", name, a.ID, typ)
+					}
+				}
+			}
+		}
+	}
+}
+
+// kaitaiTypes are the names of the types of a seq attribute, type is a name or a switch-on
+func kaitaiTypes(typ interface{}) []string {
+	switch t := typ.(type) {
+	case string:
+		return []string{t}
+	case map[string]interface{}:
+		names := []string{}
+		cases, _ := t["cases"].(map[string]interface{})
+		for _, c := range cases {
+			names = append(names, kaitaiTypes(c)...)
+		}
+		return names
+	}
+	return nil
+}
@@ -3,8 +3,9 @@ package main
 
 import "fmt"
 
-// lets generate code for this struct
-// cgen: binpack
+// lets generate code for this struct,
+// the layout is the one of perl pack("L L/a* L", ...)
+// cgen: binpack template="L L/a* L"
 type User struct {
 	ID       int
 	RealName string `cgen:"-"`
@@ -12,6 +13,66 @@ type User struct {
 	Flags    int
 }
 
+// nested binpack structs, slices and arrays of any supported type
+// cgen: binpack
+type Session struct {
+	ID      uint64
+	Owner   User
+	Guests  []User
+	Scopes  []string
+	Token   [16]byte
+	Payload []byte
+	Ports   []uint16
+	Expires int64
+	Active  bool
+	Rating  float64
+	Grid    [2][3]int8
+}
+
+// header of a big-endian network protocol with short length prefixes
+// cgen: binpack be len=u16
+type Packet struct {
+	Version  uint8
+	Flags    uint16
+	Sequence int
+	Name     string   `cgen:"size=8"`
+	Tags     []string `cgen:"len=u8"`
+	Payload  []byte   `cgen:"len=varint"`
+	Checksum uint32   `cgen:"le"`
+}
+
+// compact event, small numbers take one byte
+// cgen: binpack varint
+type Event struct {
+	ID      uint64
+	Kind    uint16
+	Delta   int
+	Offsets []int32
+	Mask    uint32 `cgen:"fixed"`
+	Level   int8
+	Payload []byte
+}
+
+// fields are numbered, so services with different versions read each other,
+// number 3 belonged to a removed field
+// cgen: binpack reserved=3
+type Profile struct {
+	ID    int    `cgen:"id=1"`
+	Login string `cgen:"id=2"`
+	Flags int    `cgen:"id=4,default=16"`
+}
+
+// next version of Profile without Login
+// cgen: binpack reserved=2,3
+type ProfileV2 struct {
+	ID     int      `cgen:"id=1"`
+	Flags  int      `cgen:"id=4,default=16"`
+	Email  string   `cgen:"id=5"`
+	Owner  User     `cgen:"id=6"`
+	Scopes []string `cgen:"id=7,len=u8"`
+	Cached bool     `cgen:"-"`
+}
+
 type Avatar struct {
 	ID  int
 	Url string
@@ -34,6 +95,9 @@ func main() {
 	}
 
 	u := User{}
-	u.Unpack(data)
+	if err := u.Unpack(data); err != nil {
+		fmt.Println(err)
+		return
+	}
 	fmt.Printf("Unpacked user %#v", u)
 }
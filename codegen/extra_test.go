@@ -0,0 +1,1093 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// тесты на возможности кодогенератора сверх основного задания
+
+func TestMyApiStream(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	cases := []struct {
+		Accept  string
+		Query   string
+		Type    string
+		Prefix  string
+		Entries []CR
+	}{
+		{
+			Query:  "status=admin",
+			Type:   "application/x-ndjson",
+			Prefix: "",
+			Entries: []CR{
+				{"id": 42, "login": "rvasily", "full_name": "Vasily Romanov", "status": 20},
+			},
+		},
+		{
+			Accept: "text/event-stream",
+			Query:  "",
+			Type:   "text/event-stream",
+			Prefix: "data: ",
+			Entries: []CR{
+				{"id": 42, "login": "rvasily", "full_name": "Vasily Romanov", "status": 20},
+			},
+		},
+		{
+			Query:   "status=user",
+			Type:    "application/x-ndjson",
+			Entries: []CR{},
+		},
+	}
+
+	for idx, item := range cases {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/user/list?"+item.Query, nil)
+		if item.Accept != "" {
+			req.Header.Set("Accept", item.Accept)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("[%d] request error: %v", idx, err)
+			continue
+		}
+
+		if got := resp.Header.Get("Content-Type"); got != item.Type {
+			t.Errorf("[%d] expected content type %q, got %q", idx, item.Type, got)
+		}
+
+		entries := []CR{}
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" {
+				continue
+			}
+			if !strings.HasPrefix(line, item.Prefix) {
+				t.Errorf("[%d] expected prefix %q in %q", idx, item.Prefix, line)
+				continue
+			}
+			entry := CR{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, item.Prefix)), &entry); err != nil {
+				t.Errorf("[%d] cant unpack json: %v", idx, err)
+			}
+			entries = append(entries, entry)
+		}
+		resp.Body.Close()
+
+		var got, expected interface{}
+		data, _ := json.Marshal(entries)
+		json.Unmarshal(data, &got)
+		data, _ = json.Marshal(item.Entries)
+		json.Unmarshal(data, &expected)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("[%d] results not match\nGot: %#v\nExpected: %#v", idx, got, expected)
+		}
+	}
+}
+
+func TestMyApiStreamCancel(t *testing.T) {
+	api := NewMyApi()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req := httptest.NewRequest(http.MethodGet, "/user/list", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected http status %v, got %v", http.StatusOK, rec.Code)
+	}
+	if strings.Count(rec.Body.String(), "\n") > 1 {
+		t.Errorf("stream was not stopped after cancel: %q", rec.Body.String())
+	}
+}
+
+func TestMyApiListParams(t *testing.T) {
+	api := NewMyApi()
+	for _, form := range []string{
+		"login=mr.moderator&status=moderator&age=30",
+		"login=mr.userlogin&status=user&age=30",
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/user/create", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Auth", "100500")
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("cant create user: %s", rec.Body.String())
+		}
+	}
+
+	cases := []struct {
+		Query  string
+		Status int
+		Logins []string
+		Error  string
+	}{
+		{ // limit из встроенной Pagination
+			Query:  "limit=2",
+			Status: http.StatusOK,
+			Logins: []string{"rvasily", "mr.moderator"},
+		},
+		{ // поля вложенной структуры приходят через точку
+			Query:  "login.prefix=mr.&login.suffix=login",
+			Status: http.StatusOK,
+			Logins: []string{"mr.userlogin"},
+		},
+		{
+			Query:  "login.prefix=mr.&limit=1",
+			Status: http.StatusOK,
+			Logins: []string{"mr.moderator"},
+		},
+		{
+			Query:  "limit=101",
+			Status: http.StatusBadRequest,
+			Error:  "limit must be <= 100",
+		},
+		{
+			Query:  "limit=many",
+			Status: http.StatusBadRequest,
+			Error:  "limit must be int",
+		},
+		{ // валидация идёт и во вложенные структуры
+			Query:  "login.suffix=" + strings.Repeat("x", 33),
+			Status: http.StatusBadRequest,
+			Error:  "login.suffix len must be <= 32",
+		},
+	}
+
+	for idx, item := range cases {
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/user/list?"+item.Query, nil))
+		if rec.Code != item.Status {
+			t.Errorf("[%d] expected http status %v, got %v", idx, item.Status, rec.Code)
+		}
+
+		if item.Error != "" {
+			result := CR{}
+			json.Unmarshal(rec.Body.Bytes(), &result)
+			if result["error"] != item.Error {
+				t.Errorf("[%d] expected error %q, got %#v", idx, item.Error, result["error"])
+			}
+			continue
+		}
+
+		logins := []string{}
+		decoder := json.NewDecoder(rec.Body)
+		for decoder.More() {
+			user := User{}
+			if err := decoder.Decode(&user); err != nil {
+				t.Errorf("[%d] cant unpack json: %v", idx, err)
+				break
+			}
+			logins = append(logins, user.Login)
+		}
+		if !reflect.DeepEqual(logins, item.Logins) {
+			t.Errorf("[%d] expected logins %v, got %v", idx, item.Logins, logins)
+		}
+	}
+
+	// вложенные объекты в json параметрах раскладываются в те же имена
+	req := httptest.NewRequest(http.MethodPost, "/user/batch",
+		strings.NewReader(`[{"url": "/user/list", "params": {"limit": 1, "login": {"prefix": "mr.", "suffix": "login"}}}]`))
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), `"login":"mr.userlogin"`) {
+		t.Errorf("nested params not bound: %s", rec.Body.String())
+	}
+}
+
+func TestMyApiJSONRPC(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	cases := []struct {
+		Body   string
+		Auth   bool
+		Result interface{}
+	}{
+		{ // обычный вызов с именованными параметрами
+			Body: `{"jsonrpc": "2.0", "method": "MyApi.Profile", "params": {"login": "rvasily"}, "id": 1}`,
+			Result: CR{
+				"jsonrpc": "2.0",
+				"id":      1,
+				"result": CR{
+					"id":        42,
+					"login":     "rvasily",
+					"full_name": "Vasily Romanov",
+					"status":    20,
+				},
+			},
+		},
+		{ // числа в параметрах проходят ту же валидацию, что и в форме
+			Body: `{"jsonrpc": "2.0", "method": "MyApi.Create", "params": {"login": "mr.moderator", "age": 256}, "id": "a"}`,
+			Auth: true,
+			Result: CR{
+				"jsonrpc": "2.0",
+				"id":      "a",
+				"error":   CR{"code": -32602, "message": "age must be <= 128", "data": CR{"status": 400}},
+			},
+		},
+		{
+			Body: `{"jsonrpc": "2.0", "method": "MyApi.Create", "params": {"login": "mr.moderator", "age": 32}, "id": 2}`,
+			Result: CR{
+				"jsonrpc": "2.0",
+				"id":      2,
+				"error":   CR{"code": -32000, "message": "unauthorized", "data": CR{"status": 403}},
+			},
+		},
+		{ // null - это отсутствующий параметр: для status подставляется значение по умолчанию
+			Body: `{"jsonrpc": "2.0", "method": "MyApi.Create", "params": {"login": "mr.moderator", "age": 32, "status": null}, "id": 6}`,
+			Auth: true,
+			Result: CR{
+				"jsonrpc": "2.0",
+				"id":      6,
+				"result":  CR{"id": 43},
+			},
+		},
+		{ // а обязательный login не проходит проверку
+			Body: `{"jsonrpc": "2.0", "method": "MyApi.Profile", "params": {"login": null}, "id": 7}`,
+			Result: CR{
+				"jsonrpc": "2.0",
+				"id":      7,
+				"error":   CR{"code": -32602, "message": "login must me not empty", "data": CR{"status": 400}},
+			},
+		},
+		{
+			Body: `{"jsonrpc": "2.0", "method": "MyApi.Unknown", "id": 3}`,
+			Result: CR{
+				"jsonrpc": "2.0",
+				"id":      3,
+				"error":   CR{"code": -32601, "message": "method not found"},
+			},
+		},
+		{
+			Body: `{"jsonrpc": "2.0", "method": "MyApi.Profile", "params": ["rvasily"], "id": 4}`,
+			Result: CR{
+				"jsonrpc": "2.0",
+				"id":      4,
+				"error":   CR{"code": -32602, "message": "params must be an object"},
+			},
+		},
+		{
+			Body: `{"jsonrpc": "2.0", "method": "MyApi.Profile", "params": {"login": "bad_user"}, "id": 5}`,
+			Result: CR{
+				"jsonrpc": "2.0",
+				"id":      5,
+				"error":   CR{"code": -32603, "message": "bad user"},
+			},
+		},
+		{
+			Body: `{"jsonrpc": "2.0", "method"`,
+			Result: CR{
+				"jsonrpc": "2.0",
+				"id":      nil,
+				"error":   CR{"code": -32700, "message": "parse error"},
+			},
+		},
+		{ // пачка запросов, уведомление без id не получает ответа
+			Body: `[
+				{"jsonrpc": "2.0", "method": "MyApi.Profile", "params": {"login": "not_exist_user"}, "id": 1},
+				{"jsonrpc": "2.0", "method": "MyApi.Profile", "params": {"login": "rvasily"}},
+				1
+			]`,
+			Result: []interface{}{
+				CR{
+					"jsonrpc": "2.0",
+					"id":      1,
+					"error":   CR{"code": -32000, "message": "user not exist", "data": CR{"status": 404}},
+				},
+				CR{
+					"jsonrpc": "2.0",
+					"id":      nil,
+					"error":   CR{"code": -32600, "message": "invalid request"},
+				},
+			},
+		},
+	}
+
+	for idx, item := range cases {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/user/rpc", strings.NewReader(item.Body))
+		req.Header.Set("Content-Type", "application/json")
+		if item.Auth {
+			req.Header.Add("X-Auth", "100500")
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("[%d] request error: %v", idx, err)
+			continue
+		}
+
+		var result, expected interface{}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("[%d] cant unpack json: %v", idx, err)
+			continue
+		}
+
+		data, _ := json.Marshal(item.Result)
+		json.Unmarshal(data, &expected)
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("[%d] results not match\nGot: %#v\nExpected: %#v", idx, result, expected)
+		}
+	}
+}
+
+func TestMyApiBatch(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	cases := []struct {
+		Mode   string
+		Body   string
+		Status int
+		Result interface{}
+	}{
+		{ // каждый вызов проходит ту же авторизацию и валидацию, что и отдельный запрос
+			Body: `[
+				{"url": "/user/profile", "params": {"login": "rvasily"}},
+				{"url": "/user/create", "method": "POST", "params": {"login": "mr.batchuser", "age": 256}},
+				{"url": "/user/create", "method": "POST", "params": {"login": "mr.batchuser", "age": 32}},
+				{"url": "/user/unknown"},
+				{"url": "/user/batch", "method": "POST"}
+			]`,
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": []interface{}{
+					CR{"status": 200, "body": CR{
+						"error": "",
+						"response": CR{
+							"id":        42,
+							"login":     "rvasily",
+							"full_name": "Vasily Romanov",
+							"status":    20,
+						},
+					}},
+					CR{"status": 400, "body": CR{"error": "age must be <= 128"}},
+					CR{"status": 200, "body": CR{"error": "", "response": CR{"id": 43}}},
+					CR{"status": 404, "body": CR{"error": "unknown method"}},
+					CR{"status": 400, "body": CR{"error": "bad url"}},
+				},
+			},
+		},
+		{ // параллельно результаты идут в порядке вызовов
+			Mode: "parallel",
+			Body: `[
+				{"url": "/user/profile", "params": {"login": "not_exist_user"}},
+				{"url": "/user/profile?login=rvasily"}
+			]`,
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": []interface{}{
+					CR{"status": 404, "body": CR{"error": "user not exist"}},
+					CR{"status": 200, "body": CR{
+						"error": "",
+						"response": CR{
+							"id":        42,
+							"login":     "rvasily",
+							"full_name": "Vasily Romanov",
+							"status":    20,
+						},
+					}},
+				},
+			},
+		},
+		{
+			Body:   `{"url": "/user/profile"}`,
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "batch must be an array of calls"},
+		},
+		{
+			Body:   `[` + strings.Repeat(`{"url": "/user/profile"},`, 50) + `{"url": "/user/profile"}]`,
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "batch must have <= 50 calls"},
+		},
+	}
+
+	for idx, item := range cases {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/user/batch?mode="+item.Mode, strings.NewReader(item.Body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Add("X-Auth", "100500")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("[%d] request error: %v", idx, err)
+			continue
+		}
+
+		var result, expected interface{}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("[%d] cant unpack json: %v", idx, err)
+			continue
+		}
+		if resp.StatusCode != item.Status {
+			t.Errorf("[%d] expected http status %v, got %v", idx, item.Status, resp.StatusCode)
+		}
+
+		data, _ := json.Marshal(item.Result)
+		json.Unmarshal(data, &expected)
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("[%d] results not match\nGot: %#v\nExpected: %#v", idx, result, expected)
+		}
+	}
+}
+
+func TestMyApiLocale(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	cases := []struct {
+		Language string
+		Path     string
+		Body     string
+		Error    string
+	}{
+		{ // без заголовка сообщения остаются прежними
+			Path:  "/user/create",
+			Body:  "login=short&age=1",
+			Error: "login len must be >= 10",
+		},
+		{
+			Language: "en-US,en;q=0.9",
+			Path:     "/user/create",
+			Body:     "age=1",
+			Error:    "login must not be empty",
+		},
+		{
+			Language: "ru-RU,ru;q=0.9,en;q=0.8",
+			Path:     "/user/create",
+			Body:     "age=1",
+			Error:    "login: обязательный параметр",
+		},
+		{
+			Language: "ru",
+			Path:     "/user/create",
+			Body:     "login=mr.moderator&age=old",
+			Error:    "age: неверный тип, ожидается int",
+		},
+		{ // языка без каталога нет, выбирается следующий по весу
+			Language: "de-DE, ru;q=0.5",
+			Path:     "/user/create",
+			Body:     "login=mr.moderator&age=1&status=root",
+			Error:    "status: допустимые значения [user, moderator, admin]",
+		},
+		{
+			Language: "de-DE",
+			Path:     "/user/create",
+			Body:     "login=mr.moderator&age=200",
+			Error:    "age must be <= 128",
+		},
+		{ // сообщение переопределено тегом apimessages
+			Language: "en",
+			Path:     "/user/create",
+			Body:     "login=short&age=1",
+			Error:    "login must be at least 10 characters",
+		},
+		{
+			Language: "ru",
+			Path:     "/user/create",
+			Body:     "login=short&age=1",
+			Error:    "логин должен быть не короче 10 символов",
+		},
+	}
+
+	for idx, item := range cases {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+item.Path, strings.NewReader(item.Body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Auth", "100500")
+		if item.Language != "" {
+			req.Header.Set("Accept-Language", item.Language)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("[%d] request error: %v", idx, err)
+			continue
+		}
+		result := CR{}
+		json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("[%d] expected http status %v, got %v", idx, http.StatusBadRequest, resp.StatusCode)
+		}
+		if result["error"] != item.Error {
+			t.Errorf("[%d] expected error %q, got %#v", idx, item.Error, result["error"])
+		}
+	}
+
+	// json-rpc берёт язык из заголовка запроса
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/user/rpc",
+		strings.NewReader(`{"jsonrpc": "2.0", "method": "MyApi.Profile", "params": {}, "id": 1}`))
+	req.Header.Set("Accept-Language", "ru")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	defer resp.Body.Close()
+	result := struct {
+		Error CR `json:"error"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result.Error["message"] != "login: обязательный параметр" {
+		t.Errorf("unexpected rpc error: %#v", result.Error)
+	}
+}
+
+func TestMyApiCORS(t *testing.T) {
+	api := NewMyApi()
+
+	cases := []struct {
+		Method  string
+		Path    string
+		Origin  string
+		Request string
+		Status  int
+		Headers map[string]string
+	}{
+		{ // preflight на эндпоинт со своими настройками
+			Method:  http.MethodOptions,
+			Path:    ApiUserProfile,
+			Origin:  "https://other.example.com",
+			Request: http.MethodGet,
+			Status:  http.StatusNoContent,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":  "*",
+				"Access-Control-Allow-Methods": "GET, POST",
+				"Access-Control-Max-Age":       "3600",
+			},
+		},
+		{ // preflight на эндпоинт с настройками структуры
+			Method:  http.MethodOptions,
+			Path:    ApiUserCreate,
+			Origin:  "https://app.example.com",
+			Request: http.MethodPost,
+			Status:  http.StatusNoContent,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Methods":     "POST",
+				"Access-Control-Allow-Headers":     "Content-Type, X-Auth",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Max-Age":           "600",
+			},
+		},
+		{
+			Method:  http.MethodOptions,
+			Path:    ApiUserCreate,
+			Origin:  "https://other.example.com",
+			Request: http.MethodPost,
+			Status:  http.StatusForbidden,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin": "",
+			},
+		},
+		{ // обычный запрос получает заголовки и проходит дальше
+			Method: http.MethodGet,
+			Path:   ApiUserProfile + "?login=rvasily",
+			Origin: "https://other.example.com",
+			Status: http.StatusOK,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin": "*",
+				"Access-Control-Max-Age":      "",
+			},
+		},
+		{
+			Method: http.MethodPost,
+			Path:   "/user/rpc",
+			Origin: "https://other.example.com",
+			Status: http.StatusOK,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin": "",
+			},
+		},
+	}
+
+	for idx, item := range cases {
+		req := httptest.NewRequest(item.Method, item.Path, strings.NewReader("{}"))
+		req.Header.Set("Origin", item.Origin)
+		if item.Request != "" {
+			req.Header.Set("Access-Control-Request-Method", item.Request)
+		}
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+
+		if rec.Code != item.Status {
+			t.Errorf("[%d] expected http status %v, got %v", idx, item.Status, rec.Code)
+		}
+		for header, expected := range item.Headers {
+			if got := rec.Header().Get(header); got != expected {
+				t.Errorf("[%d] expected %s %q, got %q", idx, header, expected, got)
+			}
+		}
+	}
+}
+
+func TestMyApiUpload(t *testing.T) {
+	api := NewMyApi()
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 64)...)
+
+	cases := []struct {
+		Login   string
+		File    []byte
+		MaxBody int64
+		Status  int
+		Result  CR
+	}{
+		{
+			Login:  "rvasily",
+			File:   png,
+			Status: http.StatusOK,
+			Result: CR{"error": "", "response": CR{"login": "rvasily", "size": len(png)}},
+		},
+		{
+			Login:  "rvasily",
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "avatar must me not empty"},
+		},
+		{
+			Login:  "rvasily",
+			File:   []byte("just some text"),
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "avatar type must be one of [image/png, image/jpeg]"},
+		},
+		{
+			Login:  "rvasily",
+			File:   append(png, make([]byte, 1<<20)...),
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "avatar size must be <= 1MB"},
+		},
+		{ // общий лимит на тело запроса
+			Login:   "rvasily",
+			File:    png,
+			MaxBody: 32,
+			Status:  http.StatusRequestEntityTooLarge,
+			Result:  CR{"error": "request body too large"},
+		},
+		{
+			Login:  "not_exist_user",
+			File:   png,
+			Status: http.StatusNotFound,
+			Result: CR{"error": "user not exist"},
+		},
+	}
+
+	defaultMaxBody := MaxBodySize
+	defer func() {
+		MaxBodySize = defaultMaxBody
+	}()
+
+	for idx, item := range cases {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		form.WriteField("login", item.Login)
+		if nil != item.File {
+			part, _ := form.CreateFormFile("avatar", "avatar.png")
+			part.Write(item.File)
+		}
+		form.Close()
+
+		MaxBodySize = defaultMaxBody
+		if item.MaxBody != 0 {
+			MaxBodySize = item.MaxBody
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/user/avatar", body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("X-Auth", "100500")
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+
+		if rec.Code != item.Status {
+			t.Errorf("[%d] expected http status %v, got %v", idx, item.Status, rec.Code)
+			continue
+		}
+
+		var result, expected interface{}
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		data, _ := json.Marshal(item.Result)
+		json.Unmarshal(data, &expected)
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("[%d] results not match\nGot: %#v\nExpected: %#v", idx, result, expected)
+		}
+	}
+}
+
+func TestMyApiVersions(t *testing.T) {
+	api := NewMyApi()
+
+	cases := []struct {
+		Path    string
+		Status  int
+		Headers map[string]string
+		Result  CR
+	}{
+		{ // старая версия помечена как устаревшая
+			Path:   ApiUserProfile + "?login=rvasily",
+			Status: http.StatusOK,
+			Headers: map[string]string{
+				"Deprecation": "true",
+				"Sunset":      "Fri, 01 Jan 2027 00:00:00 GMT",
+			},
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id":        42,
+					"login":     "rvasily",
+					"full_name": "Vasily Romanov",
+					"status":    20,
+				},
+			},
+		},
+		{ // новая версия живёт по тому же урлу с префиксом
+			Path:   "/v2" + ApiUserProfile + "?login=rvasily",
+			Status: http.StatusOK,
+			Headers: map[string]string{
+				"Deprecation": "",
+				"Sunset":      "",
+			},
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id":        42,
+					"login":     "rvasily",
+					"full_name": "Vasily Romanov",
+					"status":    "admin",
+				},
+			},
+		},
+		{
+			Path:   "/v2" + ApiUserProfile,
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "login must me not empty"},
+		},
+		{
+			Path:   "/user/versions",
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"versions": []string{"v2"},
+					"endpoints": []CR{
+						{"url": "/user/profile", "deprecated": true, "sunset": "2027-01-01"},
+						{"url": "/v2/user/profile", "version": "v2"},
+						{"url": "/user/create", "method": "POST"},
+						{"url": "/user/list", "method": "GET"},
+						{"url": "/user/avatar", "method": "POST"},
+					},
+				},
+			},
+		},
+	}
+
+	for idx, item := range cases {
+		req := httptest.NewRequest(http.MethodGet, item.Path, nil)
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+
+		if rec.Code != item.Status {
+			t.Errorf("[%d] expected http status %v, got %v", idx, item.Status, rec.Code)
+			continue
+		}
+		for header, expected := range item.Headers {
+			if got := rec.Header().Get(header); got != expected {
+				t.Errorf("[%d] expected %s %q, got %q", idx, header, expected, got)
+			}
+		}
+
+		var result, expected interface{}
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		data, _ := json.Marshal(item.Result)
+		json.Unmarshal(data, &expected)
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("[%d] results not match\nGot: %#v\nExpected: %#v", idx, result, expected)
+		}
+	}
+}
+
+func TestEnvelopes(t *testing.T) {
+	notFound := ApiError{HTTPStatus: http.StatusNotFound, Err: errors.New("user not exist"), Code: "user_not_exist"}
+
+	cases := []struct {
+		Env    envelope
+		Err    error
+		Status int
+		Type   string
+		Result interface{}
+	}{
+		{
+			Env:    envelopeLegacy,
+			Err:    notFound,
+			Status: http.StatusNotFound,
+			Type:   "application/json",
+			Result: CR{"error": "user not exist"},
+		},
+		{
+			Env:    envelopeLegacy,
+			Status: http.StatusOK,
+			Type:   "application/json",
+			Result: CR{"error": "", "response": CR{"id": 42}},
+		},
+		{
+			Env:    envelopeBare,
+			Err:    notFound,
+			Status: http.StatusNotFound,
+			Type:   "application/json",
+			Result: CR{"error": "user not exist", "code": "user_not_exist"},
+		},
+		{
+			Env:    envelopeBare,
+			Status: http.StatusOK,
+			Type:   "application/json",
+			Result: CR{"id": 42},
+		},
+		{
+			Env:    envelopeProblem,
+			Err:    notFound,
+			Status: http.StatusNotFound,
+			Type:   "application/problem+json",
+			Result: CR{
+				"type":   "urn:apierror:user_not_exist",
+				"title":  "Not Found",
+				"status": 404,
+				"detail": "user not exist",
+				"code":   "user_not_exist",
+			},
+		},
+		{ // неизвестная ошибка становится 500
+			Env:    envelopeProblem,
+			Err:    errors.New("bad user"),
+			Status: http.StatusInternalServerError,
+			Type:   "application/problem+json",
+			Result: CR{
+				"type":   "about:blank",
+				"title":  "Internal Server Error",
+				"status": 500,
+				"detail": "bad user",
+			},
+		},
+		{
+			Env:    envelopeProblem,
+			Status: http.StatusOK,
+			Type:   "application/json",
+			Result: CR{"id": 42},
+		},
+	}
+
+	for idx, item := range cases {
+		rec := httptest.NewRecorder()
+		if nil != item.Err {
+			item.Env.handleError(rec, item.Err)
+		} else {
+			item.Env.handleResult(rec, &NewUser{ID: 42})
+		}
+
+		if rec.Code != item.Status {
+			t.Errorf("[%d] expected http status %v, got %v", idx, item.Status, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Type"); got != item.Type {
+			t.Errorf("[%d] expected content type %q, got %q", idx, item.Type, got)
+		}
+
+		var result, expected interface{}
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		data, _ := json.Marshal(item.Result)
+		json.Unmarshal(data, &expected)
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("[%d] results not match\nGot: %#v\nExpected: %#v", idx, result, expected)
+		}
+	}
+}
+
+func TestMyApiPrincipal(t *testing.T) {
+	api := NewMyApi()
+
+	post := func(query, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, ApiUserCreate, strings.NewReader(query))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Auth", token)
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// админ создаёт обычного пользователя и выдаём ему токен
+	rec := post("login=regular_user&age=20&status=user", "100500")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected http status %v, got %v: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if createdBy := api.users["regular_user"].createdBy; createdBy != 42 {
+		t.Errorf("expected creator 42, got %v", createdBy)
+	}
+	api.tokens["regular_token"] = "regular_user"
+
+	cases := []struct {
+		Query  string
+		Token  string
+		Status int
+		Error  string
+	}{
+		{
+			Query:  "login=another_user&age=20&status=user",
+			Token:  "unknown_token",
+			Status: http.StatusForbidden,
+			Error:  "unauthorized",
+		},
+		{ // нельзя создать пользователя со статусом выше своего
+			Query:  "login=another_user&age=20&status=admin",
+			Token:  "regular_token",
+			Status: http.StatusForbidden,
+			Error:  "not enough rights",
+		},
+		{
+			Query:  "login=another_user&age=20&status=user",
+			Token:  "regular_token",
+			Status: http.StatusOK,
+			Error:  "",
+		},
+	}
+
+	for idx, item := range cases {
+		rec := post(item.Query, item.Token)
+		if rec.Code != item.Status {
+			t.Errorf("[%d] expected http status %v, got %v", idx, item.Status, rec.Code)
+			continue
+		}
+		result := CR{}
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		if result["error"] != item.Error {
+			t.Errorf("[%d] expected error %q, got %q", idx, item.Error, result["error"])
+		}
+	}
+
+	if createdBy := api.users["another_user"].createdBy; createdBy != api.users["regular_user"].ID {
+		t.Errorf("expected creator %v, got %v", api.users["regular_user"].ID, createdBy)
+	}
+}
+
+func TestMyApiCache(t *testing.T) {
+	api := NewMyApi()
+	// кеш живёт в хендлере, поэтому он один на все запросы
+	handler := NewMyApiHandler(api)
+
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get(ApiUserProfile+"?login=rvasily", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with ETag, got %v %q", rec.Code, etag)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "max-age=30" {
+		t.Errorf("expected Cache-Control max-age=30, got %q", got)
+	}
+
+	rec = get(ApiUserProfile+"?login=rvasily", etag)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("expected empty 304, got %v %q", rec.Code, rec.Body.String())
+	}
+	rec = get(ApiUserProfile+"?login=rvasily", `"other", W/`+etag)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for etag list, got %v", rec.Code)
+	}
+	rec = get(ApiUserProfile+"?login=rvasily", `"other"`)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for other etag, got %v", rec.Code)
+	}
+
+	// ошибки не кешируются и не получают ETag
+	rec = get(ApiUserProfile+"?login=not_exist_user", "")
+	if rec.Code != http.StatusNotFound || rec.Header().Get("ETag") != "" {
+		t.Errorf("expected 404 without ETag, got %v %q", rec.Code, rec.Header().Get("ETag"))
+	}
+
+	// v2 отдаёт ответ из кеша, пока не истёк ttl
+	rec = get("/v2"+ApiUserProfile+"?login=rvasily", "")
+	first := rec.Body.String()
+	api.users["rvasily"] = &User{ID: 42, Login: "rvasily", FullName: "Changed Name", Status: statusAdmin}
+	rec = get("/v2"+ApiUserProfile+"?unknown=1&login=rvasily", "")
+	if rec.Body.String() != first {
+		t.Errorf("expected cached response %q, got %q", first, rec.Body.String())
+	}
+
+	// хендлер другого экземпляра api не видит чужой кеш
+	other := NewMyApi()
+	other.users["rvasily"] = &User{ID: 42, Login: "rvasily", FullName: "Other Name", Status: statusAdmin}
+	rec = httptest.NewRecorder()
+	NewMyApiHandler(other).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2"+ApiUserProfile+"?login=rvasily", nil))
+	if !strings.Contains(rec.Body.String(), "Other Name") {
+		t.Errorf("expected fresh response, got %q", rec.Body.String())
+	}
+	// новый хендлер того же api начинает с пустым кешем
+	other.users["rvasily"].FullName = "Next Name"
+	rec = httptest.NewRecorder()
+	NewMyApiHandler(other).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2"+ApiUserProfile+"?login=rvasily", nil))
+	if !strings.Contains(rec.Body.String(), "Next Name") {
+		t.Errorf("expected fresh response, got %q", rec.Body.String())
+	}
+}
+
+func TestMyApiHandlerFake(t *testing.T) {
+	var gotLogin string
+	fake := &MyApiServiceFake{
+		ProfileFunc: func(ctx context.Context, in ProfileParams) (*User, error) {
+			gotLogin = in.Login
+			return &User{ID: 1, Login: in.Login, FullName: "Fake User"}, nil
+		},
+		AuthenticateFunc: func(ctx context.Context, token string) (*User, error) {
+			return &User{ID: 7, Status: statusUser}, nil
+		},
+	}
+	handler := NewMyApiHandler(fake)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, ApiUserProfile+"?login=somebody", nil))
+	if rec.Code != http.StatusOK || gotLogin != "somebody" {
+		t.Errorf("expected fake profile, got %v %q", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "Fake User") {
+		t.Errorf("expected fake user in response, got %q", rec.Body.String())
+	}
+
+	// валидация и авторизация остаются в сгенерированном слое,
+	// а не настроенный метод фейка отвечает ошибкой
+	req := httptest.NewRequest(http.MethodPost, ApiUserCreate, strings.NewReader("login=new_moderator&age=32"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "MyApiServiceFake.Create is not configured") {
+		t.Errorf("expected not configured error, got %v %q", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, ApiUserCreate, strings.NewReader("login=short&age=32"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected validation error, got %v %q", rec.Code, rec.Body.String())
+	}
+}
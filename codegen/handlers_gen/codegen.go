@@ -1,15 +1,28 @@
+// go build -o codegen ./handlers_gen && ./codegen -fake api_fake_test.go -fuzz api_fuzz_test.go -cli cli api.go api_handlers.go
+// go test -v
 package main
 
 import (
 	"bytes"
+	"embed"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"go/types"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 )
 
 const (
@@ -20,33 +33,129 @@ type Params struct {
 	URL string `json:"url"`
 	Method string `json:"method,omitempty"`
 	Auth bool `json:"auth"`
+	CORS *CORS `json:"cors,omitempty"`
+	Version string `json:"version,omitempty"`
+	Deprecated *Deprecated `json:"deprecated,omitempty"`
+	Cache *Cache `json:"cache,omitempty"`
+}
+
+// Cache applies to GET requests only
+type Cache struct {
+	MaxAge string `json:"maxAge,omitempty"`
+	ETag bool `json:"etag,omitempty"`
+	// TTL enables the in-process response cache
+	TTL string `json:"ttl,omitempty"`
+}
+
+type Deprecated struct {
+	Since string `json:"since,omitempty"`
+	Sunset string `json:"sunset,omitempty"`
+}
+
+// ApiParams is the struct-level apigen:api annotation
+type ApiParams struct {
+	RPC string `json:"rpc,omitempty"`
+	// CORS is the default for every endpoint of the struct
+	CORS *CORS `json:"cors,omitempty"`
+	// Versions is the url listing versioned endpoints
+	Versions string `json:"versions,omitempty"`
+	// Envelope overrides the -envelope flag for the struct
+	Envelope string `json:"envelope,omitempty"`
+	// Batch is the url of the endpoint running several calls at once
+	Batch string `json:"batch,omitempty"`
+	// Principal is the type returned by the struct's Authenticate method,
+	// it is put into the context of authorized calls
+	Principal string `json:"principal,omitempty"`
+}
+
+type CORS struct {
+	Origins []string `json:"origins"`
+	Methods []string `json:"methods,omitempty"`
+	Headers []string `json:"headers,omitempty"`
+	Credentials bool `json:"credentials,omitempty"`
+	MaxAge string `json:"maxAge,omitempty"`
 }
 
 type Function struct {
 	paramsStruct string
 	params Params
 	name string
+	resultType string
+	// stream is set for methods returning a receive-only channel
+	stream bool
+}
+
+// route is the url with the version prefix
+func (function Function) route() string {
+	if function.params.Version == "" {
+		return function.params.URL
+	}
+	return "/" + function.params.Version + function.params.URL
 }
 
 type StructParams struct {
 	tag reflect.StructTag
 	paramType string
+	// name is the selector of the field in the params struct, like Address.City
 	name string
+	// prefix is prepended to the param name of fields of nested structs
+	prefix string
+	embedded bool
+}
+
+// varName is the name of the local variable holding the field while binding
+func (structParam StructParams) varName() string {
+	return strings.Replace(structParam.name, ".", "", -1)
 }
 
 var (
 	functions = make(map[string][]Function)
 	structParams = make(map[string][]StructParams)
+	// structFields are the fields of every struct as declared, before flattening
+	structFields = make(map[string][]StructParams)
+	apis = make(map[string]ApiParams)
+
+	envelopeFlag = flag.String("envelope", "legacy", "response envelope: legacy, bare or problem")
+	fakeFlag = flag.String("fake", "", "file to write fake service implementations to")
+	cliFlag = flag.String("cli", "", "directory to write command line clients to")
+	fuzzFlag = flag.String("fuzz", "", "file to write fuzz targets of the binders to")
+	templatesFlag = flag.String("templates", "", "directory with templates replacing the embedded ones of the same name")
 )
 
+//go:embed templates/*.tmpl
+var embeddedTemplates embed.FS
+
+var templates *template.Template
+
+var envelopes = map[string]string{
+	"legacy": "envelopeLegacy",
+	"bare": "envelopeBare",
+	"problem": "envelopeProblem",
+}
+
+// envelope is the generated constant shaping responses of the struct
+func envelope(baseStruct string) string {
+	name := *envelopeFlag
+	if apis[baseStruct].Envelope != "" {
+		name = apis[baseStruct].Envelope
+	}
+	env, ok := envelopes[name]
+	if !ok {
+		panic("unknown envelope " + name)
+	}
+	return env
+}
+
 func main() {
+	flag.Parse()
+
 	fset := token.NewFileSet()
-	file, err := parser.ParseFile(fset, os.Args[1], nil, parser.ParseComments)
+	file, err := parser.ParseFile(fset, flag.Arg(0), nil, parser.ParseComments)
 	if nil != err {
 		panic(err)
 	}
 
-	out, err := os.Create(os.Args[2])
+	out, err := os.Create(flag.Arg(1))
 	if nil != err {
 		panic(err)
 	}
@@ -57,17 +166,367 @@ func main() {
 		}
 	}()
 
-	fmt.Fprintln(out, `package ` + file.Name.Name)
-	fmt.Fprintln(out, `import "net/http"`)
-	fmt.Fprintln(out, `import "strconv"`)
-	fmt.Fprintln(out, `import "context"`)
-	fmt.Fprintln(out, `import "encoding/json"`)
-	fmt.Fprintln(out, `import "errors"`)
-	fmt.Fprintln(out)
-
-	params := Params{}
-	var paramsBin bytes.Buffer
-	var takeFunc bool
+	collectFunctions(file)
+	collectStructs(file)
+	templates = loadTemplates(*templatesFlag)
+
+	baseStructs := make([]string, 0, len(functions))
+	for baseStruct := range functions {
+		baseStructs = append(baseStructs, baseStruct)
+	}
+	sort.Strings(baseStructs)
+
+	view := newFileView(file.Name.Name, baseStructs)
+	render(out, "handlers.tmpl", view)
+
+	if *fakeFlag != "" {
+		writeFakes(view)
+	}
+	if *fuzzFlag != "" {
+		writeFuzz(view)
+	}
+	if *cliFlag != "" {
+		for _, baseStruct := range baseStructs {
+			writeCLI(*cliFlag, baseStruct)
+		}
+	}
+}
+
+// loadTemplates parses the embedded templates, a file of dir replaces
+// the embedded template with the same file name
+func loadTemplates(dir string) *template.Template {
+	funcs := template.FuncMap{
+		"join": strings.Join,
+	}
+	tmpl := template.Must(template.New("codegen").Funcs(funcs).ParseFS(embeddedTemplates, "templates/*.tmpl"))
+	if dir == "" {
+		return tmpl
+	}
+	overrides, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if nil != err {
+		panic(err)
+	}
+	if len(overrides) == 0 {
+		panic("no templates in " + dir)
+	}
+	return template.Must(tmpl.ParseFiles(overrides...))
+}
+
+func render(out io.Writer, name string, data interface{}) {
+	err := templates.ExecuteTemplate(out, name, data)
+	if nil != err {
+		panic(err)
+	}
+}
+
+func writeFakes(view fileView) {
+	out, err := os.Create(*fakeFlag)
+	if nil != err {
+		panic(err)
+	}
+	defer func() {
+		err := out.Close()
+		if nil != err {
+			panic(err)
+		}
+	}()
+
+	render(out, "fake.tmpl", view)
+}
+
+func writeFuzz(view fileView) {
+	out, err := os.Create(*fuzzFlag)
+	if nil != err {
+		panic(err)
+	}
+	defer func() {
+		err := out.Close()
+		if nil != err {
+			panic(err)
+		}
+	}()
+
+	render(out, "fuzz.tmpl", view)
+}
+
+// writeCLI emits the command line client of the struct into dir/<struct>/main.go
+func writeCLI(dir string, baseStruct string) {
+	name := strings.ToLower(baseStruct)
+	err := os.MkdirAll(filepath.Join(dir, name), 0755)
+	if nil != err {
+		panic(err)
+	}
+	out, err := os.Create(filepath.Join(dir, name, "main.go"))
+	if nil != err {
+		panic(err)
+	}
+	defer func() {
+		err := out.Close()
+		if nil != err {
+			panic(err)
+		}
+	}()
+
+	view := cliView{Name: name}
+	for _, function := range functions[baseStruct] {
+		view.Commands = append(view.Commands, newCommandView(baseStruct, function))
+	}
+	render(out, "cli.tmpl", view)
+}
+
+// fileView is the data of handlers.tmpl, fake.tmpl and fuzz.tmpl
+type fileView struct {
+	Package string
+	APIs []apiView
+}
+
+// apiView is an annotated struct as the templates see it
+type apiView struct {
+	Name string
+	Envelope string
+	RPC string
+	Batch string
+	Versions string
+	// CORS is set when the struct has a default CORS policy
+	CORS bool
+	// Principal is set only for the first struct with the principal type,
+	// so the accessor is emitted once
+	Principal string
+	PrincipalName string
+	Methods []methodView
+	CORSPolicies []corsView
+	Caches []cacheView
+	Routes []routeView
+	Functions []functionView
+	VersionList []string
+	// Binders are the params structs which are not bound by previous structs yet
+	Binders []binderView
+	FuzzTargets []fuzzView
+}
+
+type methodView struct {
+	Name string
+	// Params is the signature without the name
+	Params string
+	Args string
+	Result string
+	// Elem is the element type of a streamed result
+	Elem string
+}
+
+func (method methodView) Signature() string {
+	return method.Name + method.Params
+}
+
+type corsView struct {
+	Name string
+	Origins []string
+	Methods string
+	Headers string
+	Credentials bool
+	MaxAge int
+}
+
+type cacheView struct {
+	Name string
+	MaxAge int
+	ETag bool
+	TTL int64
+	TTLText string
+}
+
+type routeView struct {
+	URL string
+	// CORS is the policy variable of the route, if any
+	CORS string
+	Checks []checkView
+}
+
+type checkView struct {
+	Method string
+	Handler string
+}
+
+type functionView struct {
+	Struct string
+	Envelope string
+	Name string
+	ParamsStruct string
+	ResultType string
+	Stream bool
+	Auth bool
+	// Principal is set when the struct authenticates callers itself
+	Principal bool
+	Route string
+	Version string
+	Method string
+	Deprecated bool
+	// Deprecation and Sunset are the values of the headers
+	Deprecation string
+	Sunset string
+	SunsetDate string
+	// Cache is the policy variable of the function, if any
+	Cache string
+	CacheTTL bool
+	CacheKeys []string
+}
+
+// fuzzView is the fuzz target of a function
+type fuzzView struct {
+	Struct string
+	Name string
+	Envelope string
+	ParamsStruct string
+	Route string
+	Stream bool
+	Methods []string
+	Seeds []seedView
+}
+
+// seedView is an input of the seed corpus, as a form and as JSON-RPC params
+type seedView struct {
+	Form string
+	JSON string
+}
+
+type binderView struct {
+	Name string
+	Fields []fieldView
+}
+
+type fieldView struct {
+	// Name is the selector of the field in the params struct
+	Name string
+	Var string
+	Param string
+	Type string
+	// Optional ints may be left empty, they have a default
+	Optional bool
+	Rules []ruleView
+	param StructParams
+}
+
+// Error is the expression building the localized error of the rule
+func (field fieldView) Error(rule string, value string) string {
+	return validationError(field.param, rule, value)
+}
+
+type ruleView struct {
+	// Rule is required, default, maxsize, mime, min, max, minlen, maxlen or enum
+	Rule string
+	Value string
+	Values []string
+	Size int64
+}
+
+type cliView struct {
+	Name string
+	Commands []commandView
+}
+
+type commandView struct {
+	Name string
+	URL string
+	Method string
+	Stream bool
+	Envelope string
+	Params []cliParamView
+}
+
+type cliParamView struct {
+	Name string
+	Kind string
+	Value string
+	Usage string
+}
+
+func newFileView(pkg string, baseStructs []string) fileView {
+	view := fileView{Package: pkg}
+	principals := make(map[string]bool)
+	binders := make(map[string]bool)
+	for _, baseStruct := range baseStructs {
+		api := apis[baseStruct]
+		structFunctions := functions[baseStruct]
+		apiView := apiView{
+			Name: baseStruct,
+			Envelope: envelope(baseStruct),
+			RPC: api.RPC,
+			Batch: api.Batch,
+			Versions: api.Versions,
+			CORS: nil != api.CORS,
+			Methods: serviceMethods(baseStruct, structFunctions),
+			CORSPolicies: corsPolicies(baseStruct, structFunctions),
+			Routes: routes(baseStruct, structFunctions),
+			VersionList: versionList(structFunctions),
+		}
+		if api.Principal != "" && !principals[api.Principal] {
+			principals[api.Principal] = true
+			apiView.Principal = api.Principal
+			apiView.PrincipalName = strings.TrimPrefix(api.Principal, "*")
+		}
+		for _, function := range structFunctions {
+			if cache := newCacheView(baseStruct, function); nil != cache {
+				apiView.Caches = append(apiView.Caches, *cache)
+			}
+			apiView.Functions = append(apiView.Functions, newFunctionView(baseStruct, function))
+			apiView.FuzzTargets = append(apiView.FuzzTargets, newFuzzView(baseStruct, function))
+			if binders[function.paramsStruct] {
+				continue
+			}
+			binders[function.paramsStruct] = true
+			apiView.Binders = append(apiView.Binders, newBinderView(function.paramsStruct))
+		}
+		view.APIs = append(view.APIs, apiView)
+	}
+	return view
+}
+
+func cliKind(structParam StructParams) string {
+	switch structParam.paramType {
+	case "int":
+		return "int"
+	case "*multipart.FileHeader", "[]byte":
+		return "file"
+	}
+	return "string"
+}
+
+// cliUsage returns the default value and the --help text of the flag
+func cliUsage(structParam StructParams) (string, string) {
+	var value string
+	var hints []string
+	if cliKind(structParam) == "file" {
+		hints = append(hints, "`path` of the file")
+	}
+	lenPrefix := ""
+	if structParam.paramType == "string" {
+		lenPrefix = "len "
+	}
+
+	_, tagsArray := paramName(structParam)
+	for _, tagExpr := range tagsArray {
+		tagArray := strings.Split(tagExpr, "=")
+		switch tagArray[0] {
+		case "required":
+			hints = append(hints, "required")
+		case "default":
+			value = tagArray[1]
+		case "min":
+			hints = append(hints, lenPrefix + ">= " + tagArray[1])
+		case "max":
+			hints = append(hints, lenPrefix + "<= " + tagArray[1])
+		case "enum":
+			hints = append(hints, "one of " + tagArray[1])
+		case "maxsize":
+			hints = append(hints, "size <= " + tagArray[1])
+		case "mime":
+			hints = append(hints, "type " + tagArray[1])
+		}
+	}
+	return value, strings.Join(hints, ", ")
+}
+
+func collectFunctions(file *ast.File) {
 	for _, decl := range file.Decls {
 		funcDecl, ok := decl.(*ast.FuncDecl)
 		if !ok {
@@ -78,15 +537,17 @@ func main() {
 			continue
 		}
 
+		params := Params{}
+		var takeFunc bool
 		for _, doc := range funcDecl.Doc.List {
 			if !strings.HasPrefix(doc.Text, "// apigen:api {") {
 				continue
 			}
 
-			paramsBin = bytes.Buffer{}
+			paramsBin := bytes.Buffer{}
 			paramsBin.WriteString(doc.Text[startParam:])
 
-			err = json.Unmarshal(paramsBin.Bytes(), &params)
+			err := json.Unmarshal(paramsBin.Bytes(), &params)
 			if nil != err {
 				panic(err)
 			}
@@ -143,11 +604,25 @@ func main() {
 
 		paramsStruct := ident.Name
 
-		functions[baseStruct] = append(functions[baseStruct], Function{params: params, paramsStruct: paramsStruct, name: funcDecl.Name.Name})
+		if nil == funcType.Results || len(funcType.Results.List) != 2 {
+			continue
+		}
+
+		resultType := funcType.Results.List[0].Type
+		chanType, ok := resultType.(*ast.ChanType)
+		stream := ok && chanType.Dir == ast.RECV
 
-		takeFunc = false
+		functions[baseStruct] = append(functions[baseStruct], Function{
+			params: params,
+			paramsStruct: paramsStruct,
+			name: funcDecl.Name.Name,
+			resultType: types.ExprString(resultType),
+			stream: stream,
+		})
 	}
+}
 
+func collectStructs(file *ast.File) {
 	for _, decls := range file.Decls {
 		gen, ok := decls.(*ast.GenDecl)
 		if !ok {
@@ -165,253 +640,523 @@ func main() {
 				continue
 			}
 
+			doc := typeSpec.Doc
+			if nil == doc {
+				doc = gen.Doc
+			}
+			if nil != doc {
+				for _, comment := range doc.List {
+					if !strings.HasPrefix(comment.Text, "// apigen:api {") {
+						continue
+					}
+
+					api := ApiParams{}
+					err := json.Unmarshal([]byte(comment.Text[startParam:]), &api)
+					if nil != err {
+						panic(err)
+					}
+					apis[typeSpec.Name.Name] = api
+				}
+			}
+
 			fieldList := structType.Fields
 			if nil == fieldList {
 				continue
 			}
 
+			structFields[typeSpec.Name.Name] = []StructParams{}
 			for _, field := range fieldList.List {
-				if nil == field.Tag  {
+				var tag reflect.StructTag
+				if nil != field.Tag {
+					tag = reflect.StructTag(field.Tag.Value[1:len(field.Tag.Value) - 1])
+				}
+				paramType := types.ExprString(field.Type)
+
+				if len(field.Names) == 0 {
+					structFields[typeSpec.Name.Name] = append(structFields[typeSpec.Name.Name], StructParams{
+						paramType: paramType,
+						tag: tag,
+						name: paramType,
+						embedded: true,
+					})
 					continue
 				}
+				for _, name := range field.Names {
+					structFields[typeSpec.Name.Name] = append(structFields[typeSpec.Name.Name], StructParams{
+						paramType: paramType,
+						tag: tag,
+						name: name.Name,
+					})
+				}
+			}
+		}
+	}
+
+	for name := range structFields {
+		structParams[name] = flattenParams(name, "", "", map[string]bool{})
+	}
+}
+
+// flattenParams lists the fields of the struct to bind: fields of embedded structs
+// are bound as they are, fields of nested structs get the param name of the field
+// as a prefix, like address.city
+func flattenParams(structName string, path string, prefix string, seen map[string]bool) []StructParams {
+	if seen[structName] {
+		panic("recursive params struct " + structName)
+	}
+	seen[structName] = true
+	defer delete(seen, structName)
+
+	var params []StructParams
+	for _, field := range structFields[structName] {
+		field.name = path + field.name
+		field.prefix = prefix
+		_, nested := structFields[field.paramType]
+		switch {
+		case field.embedded && nested:
+			params = append(params, flattenParams(field.paramType, field.name + ".", prefix, seen)...)
+		case nested:
+			paramname, _ := paramName(field)
+			params = append(params, flattenParams(field.paramType, field.name + ".", paramname + ".", seen)...)
+		case field.tag == "":
+			continue
+		case field.embedded:
+			panic("embedded field " + field.paramType + " of " + structName + " must be a struct of the file")
+		default:
+			params = append(params, field)
+		}
+	}
+	return params
+}
+
+func endpointCORS(baseStruct string, function Function) *CORS {
+	if nil != function.params.CORS {
+		return function.params.CORS
+	}
+	return apis[baseStruct].CORS
+}
+
+func parseDuration(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	duration, err := time.ParseDuration(value)
+	if nil != err {
+		panic(err)
+	}
+	return duration
+}
+
+// parseDate reads dates of deprecated annotations, 2006-01-02 or RFC 3339
+func parseDate(value string) time.Time {
+	date, err := time.Parse("2006-01-02", value)
+	if nil != err {
+		date, err = time.Parse(time.RFC3339, value)
+	}
+	if nil != err {
+		panic(err)
+	}
+	return date.UTC()
+}
+
+func newCacheView(baseStruct string, function Function) *cacheView {
+	cache := function.params.Cache
+	if nil == cache {
+		return nil
+	}
+	if cache.TTL != "" && function.params.Auth {
+		panic("cache ttl is not allowed for " + baseStruct + "." + function.name + " with auth")
+	}
+
+	return &cacheView{
+		Name: "cache" + baseStruct + function.name,
+		MaxAge: int(parseDuration(cache.MaxAge).Seconds()),
+		ETag: cache.ETag,
+		TTL: int64(parseDuration(cache.TTL)),
+		TTLText: cache.TTL,
+	}
+}
+
+func newCORSView(name string, cors *CORS, methods []string, headers []string) corsView {
+	if len(cors.Methods) > 0 {
+		methods = cors.Methods
+	}
+	if len(cors.Headers) > 0 {
+		headers = cors.Headers
+	}
+
+	return corsView{
+		Name: name,
+		Origins: cors.Origins,
+		Methods: strings.Join(methods, ", "),
+		Headers: strings.Join(headers, ", "),
+		Credentials: cors.Credentials,
+		MaxAge: int(parseDuration(cors.MaxAge).Seconds()),
+	}
+}
+
+func corsPolicies(baseStruct string, structFunctions []Function) []corsView {
+	var policies []corsView
+	seen := make(map[string]bool)
+	for _, function := range structFunctions {
+		if seen[function.route()] {
+			continue
+		}
+		seen[function.route()] = true
+
+		cors := endpointCORS(baseStruct, function)
+		if nil == cors {
+			continue
+		}
 
-				structParams[typeSpec.Name.Name] = append(structParams[typeSpec.Name.Name], StructParams{
-					paramType: field.Type.(*ast.Ident).Name,
-					tag: reflect.StructTag(field.Tag.Value[1:len(field.Tag.Value) - 1]),
-					name: field.Names[0].Name,
-				})
+		var methods []string
+		headers := []string{"Content-Type"}
+		for _, other := range structFunctions {
+			if other.route() != function.route() {
+				continue
+			}
+			if other.params.Method == "" {
+				methods = append(methods, "GET", "POST")
+			} else {
+				methods = append(methods, other.params.Method)
+			}
+			if other.params.Auth {
+				headers = append(headers, "X-Auth")
 			}
 		}
+		policies = append(policies, newCORSView("cors" + baseStruct + function.name, cors, methods, headers))
 	}
 
-	for baseStruct, structFunctions := range functions {
-		fmt.Fprintln(out, "func (in *" + baseStruct + ") ServeHTTP(w http.ResponseWriter, r *http.Request) {")
-		fmt.Fprintln(out,"\tswitch r.URL.Path {")
-		methods := make(map[string][]Function)
-		for _, function := range structFunctions {
-			methods[function.params.URL] = append(methods[function.params.URL], function)
+	if api := apis[baseStruct]; api.RPC != "" && nil != api.CORS {
+		policies = append(policies, newCORSView("cors" + baseStruct + "JSONRPC", api.CORS, []string{"POST"}, []string{"Content-Type", "X-Auth"}))
+	}
+	if api := apis[baseStruct]; api.Batch != "" && nil != api.CORS {
+		policies = append(policies, newCORSView("cors" + baseStruct + "Batch", api.CORS, []string{"POST"}, []string{"Content-Type", "X-Auth"}))
+	}
+	return policies
+}
+
+// serviceMethods are the methods the generated handler needs from the struct
+func serviceMethods(baseStruct string, structFunctions []Function) []methodView {
+	var methods []methodView
+	if principal := apis[baseStruct].Principal; principal != "" {
+		methods = append(methods, methodView{
+			Name: "Authenticate",
+			Params: "(ctx context.Context, token string) (" + principal + ", error)",
+			Args: "ctx, token",
+			Result: principal,
+		})
+	}
+	for _, function := range structFunctions {
+		methods = append(methods, methodView{
+			Name: function.name,
+			Params: "(ctx context.Context, in " + function.paramsStruct + ") (" + function.resultType + ", error)",
+			Args: "ctx, in",
+			Result: function.resultType,
+		})
+		if function.stream {
+			methods[len(methods)-1].Elem = strings.TrimPrefix(function.resultType, "<-chan ")
+		}
+	}
+	return methods
+}
+
+// routes groups functions by url, in the order of the first function of the url
+func routes(baseStruct string, structFunctions []Function) []routeView {
+	var routes []routeView
+	index := make(map[string]int)
+	for _, function := range structFunctions {
+		idx, ok := index[function.route()]
+		if !ok {
+			idx = len(routes)
+			index[function.route()] = idx
+			route := routeView{URL: function.route()}
+			if nil != endpointCORS(baseStruct, function) {
+				route.CORS = "cors" + baseStruct + function.name
+			}
+			routes = append(routes, route)
+		}
+
+		methods := []string{function.params.Method}
+		if function.params.Method == "" {
+			methods = []string{"GET", "POST"}
 		}
 		for _, method := range methods {
-			for _, function := range method {
-				fmt.Fprintln(out, "\tcase \""+function.params.URL+"\":")
-				switch function.params.Method {
-				case "POST":
-					fmt.Fprintln(out, "\t\tif r.Method == \"POST\" {")
-					fmt.Fprintln(out, "\t\t\tin.handler"+function.name+"(w,r)")
-					fmt.Fprintln(out, "\t\t\treturn")
-					fmt.Fprintln(out, "\t\t}")
-				case "GET":
-					fmt.Fprintln(out, "\t\tif r.Method == \"GET\" {")
-					fmt.Fprintln(out, "\t\t\tin.handler"+function.name+"(w,r)")
-					fmt.Fprintln(out, "\t\t\treturn")
-					fmt.Fprintln(out, "\t\t}")
-				default:
-					fmt.Fprintln(out, "\t\tif r.Method == \"GET\" {")
-					fmt.Fprintln(out, "\t\t\tin.handler"+function.name+"(w,r)")
-					fmt.Fprintln(out, "\t\t\treturn")
-					fmt.Fprintln(out, "\t\t}")
-					fmt.Fprintln(out, "\t\tif r.Method == \"POST\" {")
-					fmt.Fprintln(out, "\t\t\tin.handler"+function.name+"(w,r)")
-					fmt.Fprintln(out, "\t\t\treturn")
-					fmt.Fprintln(out, "\t\t}")
-				}
+			routes[idx].Checks = append(routes[idx].Checks, checkView{Method: method, Handler: function.name})
+		}
+	}
+	return routes
+}
+
+func versionList(structFunctions []Function) []string {
+	var versions []string
+	seen := make(map[string]bool)
+	for _, function := range structFunctions {
+		if function.params.Version != "" && !seen[function.params.Version] {
+			seen[function.params.Version] = true
+			versions = append(versions, function.params.Version)
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+func newFunctionView(baseStruct string, function Function) functionView {
+	view := functionView{
+		Struct: baseStruct,
+		Envelope: envelope(baseStruct),
+		Name: function.name,
+		ParamsStruct: function.paramsStruct,
+		ResultType: function.resultType,
+		Stream: function.stream,
+		Auth: function.params.Auth,
+		Principal: apis[baseStruct].Principal != "",
+		Route: function.route(),
+		Version: function.params.Version,
+		Method: function.params.Method,
+	}
+	if deprecated := function.params.Deprecated; nil != deprecated {
+		view.Deprecated = true
+		view.Deprecation = "true"
+		if deprecated.Since != "" {
+			view.Deprecation = fmt.Sprintf("@%d", parseDate(deprecated.Since).Unix())
+		}
+		if deprecated.Sunset != "" {
+			view.Sunset = parseDate(deprecated.Sunset).Format(http.TimeFormat)
+			view.SunsetDate = parseDate(deprecated.Sunset).Format("2006-01-02")
+		}
+	}
+	if cache := function.params.Cache; nil != cache {
+		view.Cache = "cache" + baseStruct + function.name
+		view.CacheTTL = cache.TTL != ""
+		for _, structParam := range structParams[function.paramsStruct] {
+			if structParam.tag.Get("apivalidator") == "" {
+				continue
 			}
-			fmt.Fprintln(out, "\t\tapiError := ApiError{Err: errors.New(\"bad method\"), HTTPStatus: http.StatusNotAcceptable}")
-			fmt.Fprintln(out, "\t\thandleError(w, apiError)")
-			fmt.Fprintln(out, "\t\treturn")
+			paramname, _ := paramName(structParam)
+			view.CacheKeys = append(view.CacheKeys, paramname)
+		}
+	}
+	return view
+}
+
+func newFuzzView(baseStruct string, function Function) fuzzView {
+	view := fuzzView{
+		Struct: baseStruct,
+		Name: function.name,
+		Envelope: envelope(baseStruct),
+		ParamsStruct: function.paramsStruct,
+		Route: function.route(),
+		Stream: function.stream,
+		Methods: []string{function.params.Method},
+	}
+	if function.params.Method == "" {
+		view.Methods = []string{"GET", "POST"}
+	}
+
+	// the first seed passes the validation, the second one is empty
+	form := url.Values{}
+	params := make(map[string]interface{})
+	for _, field := range newBinderView(function.paramsStruct).Fields {
+		value, ok := seedValue(field)
+		if !ok {
+			continue
 		}
-		fmt.Fprintln(out, "\t}")
-		fmt.Fprintln(out, "\tapiError := ApiError{Err: errors.New(\"unknown method\"), HTTPStatus: http.StatusNotFound}")
-		fmt.Fprintln(out, "\thandleError(w, apiError)")
-		fmt.Fprintln(out, "}")
-		fmt.Fprintln(out)
+		form.Set(field.Param, value)
+		params[field.Param] = value
+		if field.Type == "int" {
+			params[field.Param] = json.Number(value)
+		}
+	}
+	raw, err := json.Marshal(params)
+	if nil != err {
+		panic(err)
+	}
+	view.Seeds = []seedView{{Form: form.Encode(), JSON: string(raw)}, {}}
+	return view
+}
 
-		for _, function := range structFunctions {
-			fmt.Fprintln(out, "func (in *" + baseStruct + ") handler" + function.name + "(w http.ResponseWriter, r *http.Request) {")
-			if function.params.Auth {
-				fmt.Fprintln(out, "\ttoken := r.Header.Get(\"X-Auth\")")
-				fmt.Fprintln(out, "\tif token != \"100500\" {")
-				fmt.Fprintln(out, "\t\tapiError := ApiError{Err: errors.New(\"unauthorized\"), HTTPStatus: http.StatusForbidden}")
-				fmt.Fprintln(out, "\t\thandleError(w, apiError)")
-				fmt.Fprintln(out, "\t\treturn")
-				fmt.Fprintln(out, "\t}")
+// seedValue is a value of the field satisfying its rules, files are not seeded
+func seedValue(field fieldView) (string, bool) {
+	if field.Type != "string" && field.Type != "int" {
+		return "", false
+	}
+	value := "1"
+	if field.Type == "string" {
+		value = "a"
+	}
+	for _, rule := range field.Rules {
+		switch rule.Rule {
+		case "default", "min":
+			value = rule.Value
+		case "minlen":
+			size, err := strconv.Atoi(rule.Value)
+			if nil != err {
+				panic(err)
 			}
-			fmt.Fprintln(out, "\tparams := " + function.paramsStruct + "{}")
-			for _, structParam := range structParams[function.paramsStruct] {
-				tags := structParam.tag.Get("apivalidator")
-				if tags == "" {
-					continue
-				}
+			value = strings.Repeat("a", size)
+		case "enum":
+			return rule.Values[0], true
+		}
+	}
+	return value, true
+}
 
-				tags = strings.Replace(tags, " ", "", -1)
+func newBinderView(paramsStruct string) binderView {
+	view := binderView{Name: paramsStruct}
+	for _, structParam := range structParams[paramsStruct] {
+		if structParam.tag.Get("apivalidator") == "" {
+			continue
+		}
+		paramname, _ := paramName(structParam)
+		field := fieldView{
+			Name: structParam.name,
+			Var: structParam.varName(),
+			Param: paramname,
+			Type: structParam.paramType,
+			Rules: rules(structParam),
+			param: structParam,
+		}
+		for _, rule := range field.Rules {
+			field.Optional = field.Optional || rule.Rule == "default"
+		}
+		view.Fields = append(view.Fields, field)
+	}
+	return view
+}
 
-				paramname := strings.ToLower(structParam.name)
-				tagsArray := strings.Split(tags, ",")
-				for _, tagExpr := range tagsArray {
-					tagArray := strings.Split(tagExpr, "=")
-					if tagArray[0] == "paramname" {
-						paramname = tagArray[1]
-						break
-					}
-				}
-				switch structParam.paramType {
-				case "int":
-					fmt.Fprintln(out, "\t" + structParam.name + ", err := strconv.Atoi(r.FormValue(\"" + paramname + "\"))")
-					fmt.Fprintln(out, "\tif nil != err {")
-					fmt.Fprintln(out, "\t\tapiError := ApiError{Err: errors.New(\"" + paramname + " must be int\"), HTTPStatus: http.StatusBadRequest}")
-					fmt.Fprintln(out, "\t\thandleError(w, apiError)")
-					fmt.Fprintln(out, "\t\treturn")
-					fmt.Fprintln(out, "\t}")
-					fmt.Fprintln(out, "\tparams." + structParam.name + " = " + structParam.name)
-				case "string":
-					fmt.Fprintln(out, "\tparams." + structParam.name + " = r.FormValue(\""+paramname+"\")")
-				}
+// rules of the field in the order they are checked: required first,
+// then the default, then the rest as they are written in the tag
+func rules(structParam StructParams) []ruleView {
+	var rules []ruleView
+	_, tagsArray := paramName(structParam)
+
+	for _, tagExpr := range tagsArray {
+		if tagExpr == "required" {
+			rules = append(rules, ruleView{Rule: "required"})
+			break
+		}
+	}
+
+	for _, tagExpr := range tagsArray {
+		tagArray := strings.Split(tagExpr, "=")
+		if tagArray[0] == "default" {
+			rules = append(rules, ruleView{Rule: "default", Value: tagArray[1]})
+			break
+		}
+	}
+
+	for _, tagExpr := range tagsArray {
+		tagArray := strings.Split(tagExpr, "=")
+		switch tagArray[0] {
+		case "maxsize":
+			rules = append(rules, ruleView{Rule: "maxsize", Value: tagArray[1], Size: parseSize(tagArray[1])})
+		case "mime":
+			rules = append(rules, ruleView{Rule: "mime", Values: strings.Split(tagArray[1], "|")})
+		case "min", "max":
+			switch structParam.paramType {
+			case "string":
+				rules = append(rules, ruleView{Rule: tagArray[0] + "len", Value: tagArray[1]})
+			case "int":
+				rules = append(rules, ruleView{Rule: tagArray[0], Value: tagArray[1]})
 			}
-			for _, structParam := range structParams[function.paramsStruct] {
-				tags := structParam.tag.Get("apivalidator")
-				if tags == "" {
-					continue
-				}
+		case "enum":
+			rules = append(rules, ruleView{Rule: "enum", Values: strings.Split(tagArray[1], "|")})
+		}
+	}
+	return rules
+}
 
-				tags = strings.Replace(tags, " ", "", -1)
+func newCommandView(baseStruct string, function Function) commandView {
+	view := commandView{
+		Name: strings.ToLower(function.name),
+		URL: function.route(),
+		Method: function.params.Method,
+		Stream: function.stream,
+		Envelope: strings.ToLower(strings.TrimPrefix(envelope(baseStruct), "envelope")),
+	}
+	if view.Method == "" {
+		view.Method = http.MethodGet
+	}
+	for _, structParam := range structParams[function.paramsStruct] {
+		if structParam.tag.Get("apivalidator") == "" {
+			continue
+		}
+		if cliKind(structParam) == "file" && view.Method == http.MethodGet {
+			view.Method = http.MethodPost
+		}
+		paramname, _ := paramName(structParam)
+		value, usage := cliUsage(structParam)
+		view.Params = append(view.Params, cliParamView{
+			Name: paramname,
+			Kind: cliKind(structParam),
+			Value: value,
+			Usage: usage,
+		})
+	}
+	return view
+}
 
-				paramname := strings.ToLower(structParam.name)
-				tagsArray := strings.Split(tags, ",")
-				for _, tagExpr := range tagsArray {
-					tagArray := strings.Split(tagExpr, "=")
-					if tagArray[0] == "paramname" {
-						paramname = tagArray[1]
-						break
-					}
-				}
+func paramName(structParam StructParams) (string, []string) {
+	tags := structParam.tag.Get("apivalidator")
+	tags = strings.Replace(tags, " ", "", -1)
 
-				for _, tagExpr := range tagsArray {
-					if tagExpr == "required" {
-						switch structParam.paramType {
-						case "string":
-							fmt.Fprintln(out, "\tif params."+structParam.name+" == \"\" {")
-						case "int":
-							fmt.Fprintln(out, "\tif params."+structParam.name+" == 0 {")
-						}
-						fmt.Fprintln(out, "\t\tapiError := ApiError{Err: errors.New(\""+paramname+" must me not empty\"), HTTPStatus: http.StatusBadRequest}")
-						fmt.Fprintln(out, "\t\thandleError(w, apiError)")
-						fmt.Fprintln(out, "\t\treturn")
-						fmt.Fprintln(out, "\t}")
-						break
-					}
-				}
+	name := structParam.name[strings.LastIndex(structParam.name, ".") + 1:]
+	paramname := strings.ToLower(name)
+	tagsArray := strings.Split(tags, ",")
+	for _, tagExpr := range tagsArray {
+		tagArray := strings.Split(tagExpr, "=")
+		if tagArray[0] == "paramname" {
+			paramname = tagArray[1]
+			break
+		}
+	}
 
-				for _, tagExpr := range tagsArray {
-					tagArray := strings.Split(tagExpr, "=")
-					if tagArray[0] == "default" {
-						switch structParam.paramType {
-						case "string":
-							fmt.Fprintln(out, "\tif params." + structParam.name + " == \"\" {")
-							fmt.Fprintln(out, "\t\tparams." + structParam.name + " = \"" + tagArray[1] + "\"")
-						case "int":
-							fmt.Fprintln(out, "\tif params." + structParam.name + " == 0 {")
-							fmt.Fprintln(out, "\t\tparams." + structParam.name + " = " + tagArray[1])
-						}
-						fmt.Fprintln(out, "\t}")
-						break
-					}
-				}
+	return structParam.prefix + paramname, tagsArray
+}
 
-				for _, tagExpr := range tagsArray {
-					tagArray := strings.Split(tagExpr, "=")
-					switch tagArray[0] {
-					case "min":
-						switch structParam.paramType {
-						case "string":
-							fmt.Fprintln(out, "\tif len(params." + structParam.name + ") < " + tagArray[1] + " {")
-							fmt.Fprintln(out, "\t\tapiErr := ApiError{Err: errors.New(\"" + paramname + " len must be >= " + tagArray[1] + "\"), HTTPStatus: http.StatusBadRequest}")
-						case "int":
-							fmt.Fprintln(out, "\tif params." + structParam.name + " < " + tagArray[1] + " {")
-							fmt.Fprintln(out, "\t\tapiErr := ApiError{Err: errors.New(\"" + paramname + " must be >= " + tagArray[1] + "\"), HTTPStatus: http.StatusBadRequest}")
-						}
-						fmt.Fprintln(out, "\t\thandleError(w, apiErr)")
-						fmt.Fprintln(out, "\t\treturn")
-						fmt.Fprintln(out, "\t}")
-					case "max":
-						switch structParam.paramType {
-						case "string":
-							fmt.Fprintln(out, "\tif len(params." + structParam.name + ") > " + tagArray[1] + " {")
-							fmt.Fprintln(out, "\t\tapiErr := ApiError{Err: errors.New(\"" + paramname + " len must be <= " + tagArray[1] + "\"), HTTPStatus: http.StatusBadRequest}")
-						case "int":
-							fmt.Fprintln(out, "\tif params." + structParam.name + " > " + tagArray[1] + " {")
-							fmt.Fprintln(out, "\t\tapiErr := ApiError{Err: errors.New(\"" + paramname + " must be <= " + tagArray[1] + "\"), HTTPStatus: http.StatusBadRequest}")
-						}
-						fmt.Fprintln(out, "\t\thandleError(w, apiErr)")
-						fmt.Fprintln(out, "\t\treturn")
-						fmt.Fprintln(out, "\t}")
-					case "enum":
-						enumValues := strings.Split(tagArray[1], "|")
-						enumValuesForErr := strings.Replace(tagArray[1], "|", ", ", -1)
-						if len(enumValues) == 0 {
-							continue
-						}
-
-						switch structParam.paramType {
-						case "string":
-							fmt.Fprint(out, "\tif params." + structParam.name + " != \"" + enumValues[0] + "\"")
-							for i := 1; i< len(enumValues); i++ {
-								fmt.Fprint(out, " &&\n\t\tparams." + structParam.name + " != \"" + enumValues[i] + "\"")
-							}
-						case "int":
-							fmt.Fprint(out, "\tif params." + structParam.name + " != " + enumValues[0])
-							for i := 1; i< len(enumValues); i++ {
-								fmt.Fprint(out, " &&\n\t\tparams." + structParam.name + " != " + enumValues[i])
-							}
-						}
-						fmt.Fprintln(out, " {")
-						fmt.Fprintln(out, "\t\tapiErr := ApiError{Err: errors.New(\"" + paramname + " must be one of [" + enumValuesForErr + "]\"), HTTPStatus: http.StatusBadRequest}")
-						fmt.Fprintln(out, "\t\thandleError(w, apiErr)")
-						fmt.Fprintln(out, "\t\treturn")
-						fmt.Fprintln(out, "\t}")
-					}
-				}
+// parseSize reads sizes like 512, 64KB or 5MB
+func parseSize(size string) int64 {
+	units := []struct {
+		suffix string
+		scale int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+	scale := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(size, unit.suffix) {
+			size = strings.TrimSuffix(size, unit.suffix)
+			scale = unit.scale
+			break
+		}
+	}
+	value, err := strconv.ParseInt(size, 10, 64)
+	if nil != err {
+		panic(err)
+	}
+	return value * scale
+}
+
+// validationError is the expression building the localized error of the rule,
+// messages of the field can be overridden with the apimessages tag:
+// `apimessages:"min=too short;ru.min=слишком короткий"`
+func validationError(structParam StructParams, rule string, value string) string {
+	paramname, _ := paramName(structParam)
+	overrides := "nil"
+	if tag := structParam.tag.Get("apimessages"); tag != "" {
+		messages := make(map[string]string)
+		for _, item := range strings.Split(tag, ";") {
+			pair := strings.SplitN(item, "=", 2)
+			if len(pair) != 2 {
+				panic("bad apimessages tag of " + structParam.name + ": " + tag)
 			}
-			fmt.Fprintln(out, "\tresult, err := in." + function.name + "(context.Background(), params)")
-			fmt.Fprintln(out, "\tif nil != err {")
-			fmt.Fprintln(out, "\t\thandleError(w, err)")
-			fmt.Fprintln(out, "\t\treturn")
-			fmt.Fprintln(out, "\t}")
-			fmt.Fprintln(out, "\thandleResult(w, result)")
-			fmt.Fprintln(out, "}")
-			fmt.Fprintln(out)
-		}
-	}
-
-	fmt.Fprintln(out, "func handleError(w http.ResponseWriter, err error) {")
-	//fmt.Fprint(out, "\tif apiError.HTTPStatus == http.StatusNotFound ")
-	//fmt.Fprint(out, "||\n\t\t apiError.HTTPStatus == http.StatusConflict ")
-	//fmt.Fprintln(out, "||\n\t\t apiError.HTTPStatus == http.StatusBadRequest {")
-	fmt.Fprintln(out, "\tapiError, ok := err.(ApiError)")
-	fmt.Fprintln(out, "\tif !ok {")
-	fmt.Fprintln(out, "\t\tapiError = ApiError{Err: err, HTTPStatus: http.StatusInternalServerError}")
-	fmt.Fprintln(out, "\t}")
-	fmt.Fprintln(out, "\tvar response = make(map[string]interface{})")
-	fmt.Fprintln(out, "\tresponse[\"error\"] = apiError.Err.Error()")
-	fmt.Fprintln(out, "\tbody, err := json.Marshal(response)")
-	fmt.Fprintln(out, "\tif nil != err {")
-	fmt.Fprintln(out, "\t\tw.WriteHeader(http.StatusInternalServerError)")
-	fmt.Fprintln(out, "\t\treturn")
-	fmt.Fprintln(out, "\t}")
-	fmt.Fprintln(out, "\tw.WriteHeader(apiError.HTTPStatus)")
-	fmt.Fprintln(out, "\tw.Write(body)")
-	fmt.Fprintln(out, "}")
-	fmt.Fprintln(out)
-
-	fmt.Fprintln(out, "func handleResult(w http.ResponseWriter, result interface{}) {")
-	fmt.Fprintln(out, "\tvar response = make(map[string]interface{})")
-	fmt.Fprintln(out, "\tresponse[\"response\"] = result")
-	fmt.Fprintln(out, "\tresponse[\"error\"] = \"\"")
-	fmt.Fprintln(out, "\tbody, err := json.Marshal(response)")
-	fmt.Fprintln(out, "\tif nil != err {")
-	fmt.Fprintln(out, "\t\tw.WriteHeader(http.StatusInternalServerError)")
-	fmt.Fprintln(out, "\t\treturn")
-	fmt.Fprintln(out, "\t}")
-	fmt.Fprintln(out, "\tw.Write(body)")
-	fmt.Fprintln(out, "}")
-
-}
\ No newline at end of file
+			messages[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+		}
+		overrides = fmt.Sprintf("%#v", messages)
+	}
+	return fmt.Sprintf("validationError(locale, %q, %q, %q, %s)", rule, paramname, value, overrides)
+}
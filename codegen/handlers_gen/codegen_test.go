@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadTemplatesOverride(t *testing.T) {
+	dir := t.TempDir()
+	override := "var {{.Name}} = customPolicy({{printf \"%q\" .Methods}})\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "cors.tmpl"), []byte(override), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	view := corsView{Name: "corsMyApiProfile", Origins: []string{"*"}, Methods: "GET, POST", MaxAge: 60}
+	cases := []struct {
+		Dir      string
+		Expected string
+	}{
+		{ // встроенный шаблон
+			Expected: "var corsMyApiProfile = &corsPolicy{\n\torigins:     []string{\"*\"},\n",
+		},
+		{ // файл с тем же именем заменяет встроенный шаблон
+			Dir:      dir,
+			Expected: "var corsMyApiProfile = customPolicy(\"GET, POST\")\n",
+		},
+	}
+
+	for idx, item := range cases {
+		templates = loadTemplates(item.Dir)
+		out := &bytes.Buffer{}
+		render(out, "cors.tmpl", view)
+		if !strings.HasPrefix(out.String(), item.Expected) {
+			t.Errorf("[%d] expected %q, got %q", idx, item.Expected, out.String())
+		}
+		// остальные шаблоны остаются встроенными
+		if nil == templates.Lookup("router.tmpl") {
+			t.Errorf("[%d] router.tmpl is lost", idx)
+		}
+	}
+}
+
+func TestSeedValue(t *testing.T) {
+	cases := []struct {
+		Field    fieldView
+		Expected string
+		Ok       bool
+	}{
+		{
+			Field:    fieldView{Type: "string", Rules: []ruleView{{Rule: "required"}, {Rule: "minlen", Value: "3"}}},
+			Expected: "aaa",
+			Ok:       true,
+		},
+		{ // первый вариант enum, а не значение по умолчанию
+			Field:    fieldView{Type: "string", Rules: []ruleView{{Rule: "default", Value: "user"}, {Rule: "enum", Values: []string{"admin", "user"}}}},
+			Expected: "admin",
+			Ok:       true,
+		},
+		{
+			Field:    fieldView{Type: "int", Rules: []ruleView{{Rule: "min", Value: "18"}, {Rule: "max", Value: "128"}}},
+			Expected: "18",
+			Ok:       true,
+		},
+		{ // файлы в корпус не попадают
+			Field: fieldView{Type: "*multipart.FileHeader", Rules: []ruleView{{Rule: "required"}}},
+		},
+	}
+
+	for idx, item := range cases {
+		value, ok := seedValue(item.Field)
+		if value != item.Expected || ok != item.Ok {
+			t.Errorf("[%d] expected %q %v, got %q %v", idx, item.Expected, item.Ok, value, ok)
+		}
+	}
+}
+
+func TestFakeZeroResult(t *testing.T) {
+	templates = loadTemplates("")
+	// результат не указатель, nil для него не компилируется
+	view := fileView{Package: "main", APIs: []apiView{{
+		Name: "CounterApi",
+		Methods: []methodView{{
+			Name:   "Count",
+			Params: "(ctx context.Context, in CountParams) (int, error)",
+			Args:   "ctx, in",
+			Result: "int",
+		}},
+	}}}
+
+	out := &bytes.Buffer{}
+	render(out, "fake.tmpl", view)
+	expected := "\t\tvar zero int\n\t\treturn zero, errors.New(\"CounterApiServiceFake.Count is not configured\")\n"
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("expected %q in %s", expected, out)
+	}
+}
+
+func TestHandlerZeroResult(t *testing.T) {
+	templates = loadTemplates("")
+	// ошибки авторизации и параметров возвращают нулевой результат, а не nil
+	cases := []functionView{
+		{Struct: "CounterApi", Envelope: "envelopeCounterApi", Name: "Count", ParamsStruct: "CountParams", ResultType: "int", Auth: true},
+		{Struct: "CounterApi", Envelope: "envelopeCounterApi", Name: "Count", ParamsStruct: "CountParams", ResultType: "int", Auth: true, Principal: true},
+	}
+
+	for idx, item := range cases {
+		out := &bytes.Buffer{}
+		render(out, "handler.tmpl", item)
+		code := out.String()
+		if !strings.Contains(code, "\tvar zero int\n") {
+			t.Errorf("[%d] expected var zero int in %s", idx, code)
+		}
+		if strings.Contains(code, "return nil,") {
+			t.Errorf("[%d] unexpected return nil in %s", idx, code)
+		}
+		if strings.Count(code, "return zero, ") != 2 {
+			t.Errorf("[%d] expected 2 returns of zero in %s", idx, code)
+		}
+	}
+}
+
+func TestBinderOptional(t *testing.T) {
+	structParams["OptionalParams"] = []StructParams{
+		{name: "Age", paramType: "int", tag: reflect.StructTag(`apivalidator:"min=0,default=18"`)},
+		// слово default в варианте enum не делает поле необязательным
+		{name: "Level", paramType: "int", tag: reflect.StructTag(`apivalidator:"enum=1|default|3"`)},
+		{name: "Count", paramType: "int", tag: reflect.StructTag(`apivalidator:"paramname=count_default"`)},
+	}
+	defer delete(structParams, "OptionalParams")
+
+	expected := []bool{true, false, false}
+	for idx, field := range newBinderView("OptionalParams").Fields {
+		if field.Optional != expected[idx] {
+			t.Errorf("[%d] %s: expected optional %v, got %v", idx, field.Name, expected[idx], field.Optional)
+		}
+	}
+}
@@ -11,8 +11,10 @@ import (
 )
 
 func main() {
-	// будет вызван метод ServeHTTP у структуры MyApi
-	http.Handle("/user/", NewMyApi())
+	// обработчик из NewMyApiHandler живёт между запросами и хранит кэш ответов
+	handler := NewMyApiHandler(NewMyApi())
+	http.Handle("/user/", handler)
+	http.Handle("/v2/", handler)
 
 	fmt.Println("starting server at :8080")
 	http.ListenAndServe(":8080", nil)